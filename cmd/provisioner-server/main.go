@@ -1,17 +1,26 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"os/user"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/resin-os/resin-provisioner/provisioner"
 )
 
 var api *provisioner.Api
 
+// How long to wait for in-flight requests on shutdown.
+const SHUTDOWN_TIMEOUT = 30 * time.Second
+
 func init() {
 	// show date/time in log output.
 	log.SetFlags(log.LstdFlags)
@@ -26,31 +35,125 @@ func handleSignals() {
 		syscall.SIGQUIT)
 
 	go func() {
-		// Any of the masked signals mean death, so only need to catch
-		// once.
-		<-in
+		sig := <-in
+		log.Printf("Received %s, shutting down.", sig)
 
+		// Serve returns once in-flight provisions have finished, or been
+		// aborted if they take too long.
+		ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+		defer cancel()
+		go api.Shutdown(ctx)
+
+		// Give up on a second signal.
+		<-in
+		api.Cancel()
 		api.Cleanup()
 		os.Exit(1)
 	}()
 }
 
 func usage() {
-	fmt.Fprintf(os.Stderr, "usage: %s [socket path] [config.json path]\n",
+	fmt.Fprintf(os.Stderr, "usage: %s [options] [socket path] [config.json path] [bundle watch dir]\n",
 		os.Args[0])
+	fmt.Fprintln(os.Stderr, "The socket path is ignored if a socket is passed by systemd socket activation.")
+	flag.PrintDefaults()
 	os.Exit(1)
 }
 
+// Parses a comma separated list of user or group names or ids.
+func parseIds(list string, lookup func(string) (string, error)) ([]uint32, error) {
+	var ret []uint32
+
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		} else if id, err := parseId(name, lookup); err != nil {
+			return nil, err
+		} else {
+			ret = append(ret, uint32(id))
+		}
+	}
+
+	return ret, nil
+}
+
+// Parses a user or group name or id, returning -1 if empty.
+func parseId(name string, lookup func(string) (string, error)) (int, error) {
+	if name == "" {
+		return -1, nil
+	} else if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	} else if idStr, err := lookup(name); err != nil {
+		return 0, err
+	} else {
+		return strconv.Atoi(idStr)
+	}
+}
+
+func lookupUser(name string) (string, error) {
+	if u, err := user.Lookup(name); err != nil {
+		return "", err
+	} else {
+		return u.Uid, nil
+	}
+}
+
+func lookupGroup(name string) (string, error) {
+	if g, err := user.LookupGroup(name); err != nil {
+		return "", err
+	} else {
+		return g.Gid, nil
+	}
+}
+
 func main() {
-	if len(os.Args) < 3 {
+	socketMode := flag.String("socket-mode", "0660", "Permissions to give the socket, in octal")
+	socketOwner := flag.String("socket-owner", "", "User to own the socket")
+	socketGroup := flag.String("socket-group", "", "Group to own the socket")
+	allowUids := flag.String("allow-users", "", "Comma separated users allowed to change the device's state, besides root")
+	allowGids := flag.String("allow-groups", "", "Comma separated groups allowed to change the device's state")
+	idleTimeout := flag.Duration("idle-timeout", 0, "Exit after this long without requests, e.g. when socket activated")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() < 2 {
 		usage()
 	}
-
-	socketPath, configPath := os.Args[1], os.Args[2]
+	socketPath, configPath := flag.Arg(0), flag.Arg(1)
 
 	api = provisioner.New(configPath)
+	auth := new(provisioner.PeerAuth)
+	var err error
+	if mode, err := strconv.ParseUint(*socketMode, 8, 32); err != nil {
+		log.Fatalf("Invalid socket mode %s: %s", *socketMode, err)
+	} else {
+		api.SocketMode = os.FileMode(mode)
+	}
+	if api.SocketUid, err = parseId(*socketOwner, lookupUser); err != nil {
+		log.Fatalf("Invalid socket owner %s: %s", *socketOwner, err)
+	} else if api.SocketGid, err = parseId(*socketGroup, lookupGroup); err != nil {
+		log.Fatalf("Invalid socket group %s: %s", *socketGroup, err)
+	} else if auth.Uids, err = parseIds(*allowUids, lookupUser); err != nil {
+		log.Fatalf("Invalid allowed users %s: %s", *allowUids, err)
+	} else if auth.Gids, err = parseIds(*allowGids, lookupGroup); err != nil {
+		log.Fatalf("Invalid allowed groups %s: %s", *allowGids, err)
+	}
+	api.Auth = auth
+	api.IdleTimeout = *idleTimeout
+
 	handleSignals()
 
+	// Optionally provision from bundles dropped in a directory, e.g. the
+	// boot partition.
+	if flag.NArg() > 2 {
+		watchDir := flag.Arg(2)
+		log.Printf("Watching %s for provisioning bundles.", watchDir)
+		go api.WatchBundles(watchDir, provisioner.BUNDLE_POLL_INTERVAL)
+	}
+
 	log.Printf("Started.")
-	api.Serve(socketPath)
+	if err := api.Serve(socketPath); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Stopped.")
 }
@@ -4,10 +4,12 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/howeyc/gopass"
 	"github.com/resin-os/resin-provisioner/provisioner"
@@ -23,6 +25,36 @@ func init() {
 var api *provisioner.Api
 var domain string
 
+// Overrides the API endpoint derived from domain if set.
+var apiEndpointFlag string
+
+// The services to manage, systemd if nil. Overridden in tests.
+var serviceManager provisioner.ServiceManager
+
+// Stands in for the API key in dry runs.
+const dryRunApiKey = "dryrun"
+
+func apiEndpoint() string {
+	if apiEndpointFlag != "" {
+		return apiEndpointFlag
+	}
+
+	return "https://api." + domain
+}
+
+// Returns an Api for the config.json at configPath, using our domain.
+func newApi(configPath string) *provisioner.Api {
+	ret := provisioner.New(configPath)
+	// An explicit endpoint is passed in provisioning options instead, as
+	// the domain would override it.
+	if apiEndpointFlag == "" {
+		ret.Domain = domain
+	}
+	ret.Services = serviceManager
+
+	return ret
+}
+
 func readInput() (input string, err error) {
 	i := bufio.NewReader(os.Stdin)
 	in, err := i.ReadString('\n')
@@ -66,12 +98,12 @@ func login() (token string, err error) {
 				return "", e
 			} else {
 				password := string(p)
-				if token, e := resin.Login("https://api."+domain, email, password); e != nil {
+				if token, e := resin.Login(apiEndpoint(), email, password); errors.Is(e, resin.ErrUnauthorized) {
+					fmt.Println("Wrong email or password, please try again.")
+				} else if e != nil {
 					return "", e
-				} else if token != "" {
-					return token, nil
 				} else {
-					fmt.Println("Wrong email or password, please try again.")
+					return token, nil
 				}
 			}
 		}
@@ -95,8 +127,10 @@ func signup() (token string, err error) {
 					password := string(p)
 					confirm := string(c)
 					if password == confirm {
-						token, err = resin.Signup("https://api."+domain, email, password)
-						if err == nil && token == "" {
+						token, err = resin.Signup(apiEndpoint(), email, password)
+						if err != nil {
+							return "", fmt.Errorf("Signup failed: %s", err)
+						} else if token == "" {
 							return "", errors.New("Signup failed")
 						} else {
 							return token, nil
@@ -135,13 +169,13 @@ func createApp(token string) (string, error) {
 		if name, e := prompt(nil, "application name: "); e != nil {
 			return "", e
 		} else if name != "" {
-			return resin.CreateApp("https://api."+domain, name, token)
+			return resin.CreateApp(apiEndpoint(), name, token)
 		}
 	}
 }
 
 func getOrCreateApp(token string) (string, error) {
-	apps, err := resin.GetApps("https://api."+domain, token)
+	apps, err := resin.GetApps(apiEndpoint(), token)
 	if err != nil {
 		return "", err
 	}
@@ -183,7 +217,7 @@ func getOrCreateApp(token string) (string, error) {
 }
 
 func getApp(token, appName string) (string, error) {
-	apps, err := resin.GetApps("https://api."+domain, token)
+	apps, err := resin.GetApps(apiEndpoint(), token)
 	if err != nil {
 		return "", err
 	}
@@ -202,12 +236,89 @@ func getApp(token, appName string) (string, error) {
 	return "", errors.New("Application not found")
 }
 
-func main() {
+// Returns the API token to use for non-interactive commands. An explicit token
+// (or RESIN_API_TOKEN) is preferred, otherwise we log in with email and
+// password.
+func getToken(token, email, password string) (string, error) {
+	if token == "" {
+		token = os.Getenv("RESIN_API_TOKEN")
+	}
+	if token != "" {
+		return token, nil
+	}
+
+	if token, e := resin.Login(apiEndpoint(), email, password); errors.Is(e, resin.ErrUnauthorized) {
+		return "", errors.New("Wrong email or password, please try again")
+	} else if e != nil {
+		return "", e
+	} else {
+		return token, nil
+	}
+}
+
+// Checks credentials were supplied, either as a token or email and password.
+func checkCredentials(token, email, password string) error {
+	if token != "" || os.Getenv("RESIN_API_TOKEN") != "" {
+		return nil
+	} else if email == "" {
+		return errors.New("Email address or API token is required")
+	} else if password == "" {
+		return errors.New("Password is required")
+	}
+
+	return nil
+}
+
+// Prints the changes provisioning with opts would make to config.json.
+func printPreview(opts *provisioner.ProvisionOpts) error {
+	changes, err := api.PreviewProvision(opts)
+	if err != nil {
+		return err
+	} else if len(changes) == 0 {
+		fmt.Println("Provisioning would not change config.json")
+		return nil
+	}
+
+	orNone := func(value string) string {
+		if value == "" {
+			return "(none)"
+		}
+		return value
+	}
+
+	fmt.Printf("Provisioning would make these changes to %s:\n", api.ConfigPath)
+	for _, change := range changes {
+		fmt.Printf("  %s: %s -> %s\n", change.Field, orNone(change.Old), orNone(change.New))
+	}
+
+	return nil
+}
+
+// Let the user know where to find their freshly provisioned device.
+func printProvisioned() error {
+	fmt.Println("Your device is now provisioned and is " +
+		"downloading and installing the resin supervisor.")
+	fmt.Println("Your device will show as configuring during " +
+		"this process, appearing online once it's complete.")
+	// There's no dashboard URL for some API endpoints, no point in
+	// worrying about that.
+	if url, err := api.DeviceUrl(); err == nil {
+		fmt.Printf("\nYou can access the device at:\n%s\n", url)
+	}
+
+	return nil
+}
+
+func newRootCmd() *cobra.Command {
 	var email string
 	var password string
+	var token string
 	var appName string
 	var configPath string
 	var dryRun bool
+	var rotateUuid bool
+	var force bool
+	var deviceName string
 
 	c := os.Getenv("CONFIG_PATH")
 	if c == "" {
@@ -227,7 +338,8 @@ help you manage device fleets.
 	}
 	rootCmd.PersistentFlags().StringVarP(&domain, "domain", "d", "resin.io", "Domain of the API server in which the device will register")
 	rootCmd.PersistentFlags().StringVarP(&configPath, "config", "c", c, "Config path for supervisor's config.json")
-	rootCmd.PersistentFlags().BoolVarP(&dryRun, "dryrun", "r", false, "Dry run (do not provision)")
+	rootCmd.PersistentFlags().StringVar(&apiEndpointFlag, "api-endpoint", "", "API server URL, overriding the one derived from the domain")
+	rootCmd.PersistentFlags().BoolVarP(&dryRun, "dryrun", "r", false, "Dry run (show the changes provisioning would make without provisioning)")
 
 	cmdProvision := &cobra.Command{
 		Use:   "provision",
@@ -241,10 +353,8 @@ See https://resin.io for more information about how resin.io can
 help you manage device fleets.
 `,
 		PreRunE: func(cmd *cobra.Command, args []string) error {
-			if email == "" {
-				return errors.New("Email address is required")
-			} else if password  == "" {
-				return errors.New("Password  is required")
+			if err := checkCredentials(token, email, password); err != nil {
+				return err
 			} else if appName == "" {
 				return errors.New("Application is required")
 			}
@@ -252,60 +362,41 @@ help you manage device fleets.
 			return nil
 		},
 		RunE: func(cmd *cobra.Command, args []string) error {
-			api = provisioner.New(configPath)
-			api.Domain = domain
-			if token, e := resin.Login("https://api."+domain, email, password); e != nil {
+			api = newApi(configPath)
+			if token, e := getToken(token, email, password); e != nil {
 				return e
-			} else if token == "" {
-				return errors.New("Wrong email or password, please try again")
 			} else if appId, err := getApp(token, appName); err != nil {
 				return err
 			} else if userId, err := resin.GetUserId(token); err != nil {
 				return err
 			} else if userName, err := resin.GetUserName(token); err != nil {
 				return err
-			} else if apiKey, err := resin.GetApiKey("https://api."+domain, appId, token); err != nil {
-				return err
 			} else {
 				opts := &provisioner.ProvisionOpts{
-					UserId: userId, UserName: userName, ApplicationId: appId, ApiKey: apiKey}
+					UserId: userId, UserName: userName, ApplicationId: appId,
+					ApiEndpoint: apiEndpointFlag, Force: force}
 
 				if dryRun {
-					fmt.Printf("Your apikey is %s\n", apiKey)
-					fmt.Printf("Ready to provision a device on appId %s for userId %s\n", appId, userId)
-					return nil
+					// Generating an API key can't be undone, so
+					// preview with a placeholder.
+					opts.ApiKey = dryRunApiKey
+					return printPreview(opts)
 				}
-				if err := api.Provision(opts); err != nil {
+				if opts.ApiKey, err = resin.GetApiKey(apiEndpoint(), appId, token); err != nil {
 					return err
-				}
-
-				// Next we need to enable the supervisor systemd service.
-				if conn, err := provisioner.NewDbus(); err != nil {
+				} else if err := api.Provision(opts); err != nil {
 					return err
-				} else {
-					defer conn.Close()
-					if err := conn.SupervisorEnableStart(); err != nil {
-						return err
-					}
-				}
-
-				// Since we're just returning a device URL no
-				// point in worrying about the error.
-				if url, err := api.DeviceUrl(); err == nil {
-					fmt.Println("Your device is now provisioned and is " +
-						"downloading and installing the resin supervisor.")
-					fmt.Println("Your device will show as configuring during " +
-						"this process, appearing online once it's complete.")
-					fmt.Printf("\nYou can access the device at:\n%s\n", url)
 				}
 
-				return nil
+				return printProvisioned()
 			}
 		},
 	}
-	cmdProvision.Flags().StringVarP(&email, "email", "e", "", "Email address of the account in which the device will register (required)")
-	cmdProvision.Flags().StringVarP(&password, "password", "p", "", "Password of the account in which the device will register (required)")
+	cmdProvision.Flags().StringVarP(&email, "email", "e", "", "Email address of the account in which the device will register (required without --token)")
+	cmdProvision.Flags().StringVarP(&password, "password", "p", "", "Password of the account in which the device will register (required without --token)")
+	cmdProvision.Flags().StringVarP(&token, "token", "t", "", "API token of the account in which the device will register, defaults to $RESIN_API_TOKEN")
 	cmdProvision.Flags().StringVarP(&appName, "application", "a", "", "Name of application in which the device will register (required)")
+	cmdProvision.Flags().BoolVarP(&force, "force", "f", false, "Discard any interrupted provision rather than resuming it")
 	rootCmd.AddCommand(cmdProvision)
 
 	cmdInteractive := &cobra.Command{
@@ -320,8 +411,7 @@ See https://resin.io for more information about how resin.io can
 help you manage device fleets.
 `,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			api = provisioner.New(configPath)
-			api.Domain = domain
+			api = newApi(configPath)
 			if token, err := authenticate(); err != nil {
 				return err
 			} else if appId, err := getOrCreateApp(token); err != nil {
@@ -330,46 +420,256 @@ help you manage device fleets.
 				return err
 			} else if userName, err := resin.GetUserName(token); err != nil {
 				return err
-			} else if apiKey, err := resin.GetApiKey("https://api."+domain, appId, token); err != nil {
-				return err
 			} else {
 				opts := &provisioner.ProvisionOpts{
-					UserId: userId, UserName: userName, ApplicationId: appId, ApiKey: apiKey}
+					UserId: userId, UserName: userName, ApplicationId: appId,
+					ApiEndpoint: apiEndpointFlag, Force: force}
 
 				if dryRun {
-					fmt.Printf("Your apikey is %s\n", apiKey)
-					fmt.Printf("Ready to provision a device on appId %s for userId %s\n", appId, userId)
-					return nil
+					// Generating an API key can't be undone, so
+					// preview with a placeholder.
+					opts.ApiKey = dryRunApiKey
+					return printPreview(opts)
 				}
-				if err := api.Provision(opts); err != nil {
+				if opts.ApiKey, err = resin.GetApiKey(apiEndpoint(), appId, token); err != nil {
+					return err
+				} else if err := api.Provision(opts); err != nil {
 					return err
 				}
 
-				// Next we need to enable the supervisor systemd service.
-				if conn, err := provisioner.NewDbus(); err != nil {
-					return err
-				} else {
-					defer conn.Close()
-					if err := conn.SupervisorEnableStart(); err != nil {
-						return err
-					}
+				return printProvisioned()
+			}
+		},
+	}
+	cmdInteractive.Flags().BoolVarP(&force, "force", "f", false, "Discard any interrupted provision rather than resuming it")
+	rootCmd.AddCommand(cmdInteractive)
+
+	cmdResume := &cobra.Command{
+		Use:   "resume",
+		Short: "Resume an interrupted provision of this device",
+		Long: `
+This command will complete the provisioning of a device which was
+interrupted, e.g. by a power cut. Steps which completed before the
+interruption are skipped, and the existing device uuid is reused so no
+duplicate device is created.
+`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			api = newApi(configPath)
+			if state, err := api.State(); err != nil {
+				return err
+			} else if state != provisioner.Provisioning &&
+				state != provisioner.RegisteredNotStarted {
+				fmt.Printf("This device is %s, nothing to resume\n", state)
+				return nil
+			} else if dryRun {
+				fmt.Println("Ready to resume provisioning this device")
+				return nil
+			}
+
+			if err := api.Resume(); err != nil {
+				return err
+			}
+
+			return printProvisioned()
+		},
+	}
+	rootCmd.AddCommand(cmdResume)
+
+	cmdDeprovision := &cobra.Command{
+		Use:   "deprovision",
+		Short: "Deprovision this device from resin.io",
+		Long: `
+This command will stop the Resin Supervisor and remove this device's
+application and registration details from config.json, so that it can
+be provisioned again without reflashing.
+`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			api = newApi(configPath)
+			if state, err := api.State(); err != nil {
+				return err
+			} else if state == provisioner.Unprovisioned {
+				fmt.Println("This device is not provisioned")
+				return nil
+			} else if dryRun {
+				fmt.Printf("Ready to deprovision a device which is %s\n", state)
+				return nil
+			}
+
+			opts := &provisioner.DeprovisionOpts{RotateUuid: rotateUuid}
+			if err := api.Deprovision(opts); err != nil {
+				return err
+			}
+
+			fmt.Println("Your device is now deprovisioned")
+			return nil
+		},
+	}
+	cmdDeprovision.Flags().BoolVarP(&rotateUuid, "rotate-uuid", "u", false, "Generate a new device uuid on the next provision")
+	rootCmd.AddCommand(cmdDeprovision)
+
+	cmdMove := &cobra.Command{
+		Use:   "move",
+		Short: "Move this device to a different resin.io application",
+		Long: `
+This command will move this already provisioned device to another
+application owned by the same account, without registering it again.
+The Resin Supervisor is restarted to pick up the new application.
+`,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := checkCredentials(token, email, password); err != nil {
+				return err
+			} else if appName == "" {
+				return errors.New("Application is required")
+			}
+
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			api = newApi(configPath)
+			if token, e := getToken(token, email, password); e != nil {
+				return e
+			} else if appId, err := getApp(token, appName); err != nil {
+				return err
+			} else if dryRun {
+				fmt.Printf("Ready to move device to appId %s\n", appId)
+				return nil
+			} else if err := api.MoveToApplication(appId, token); err != nil {
+				return err
+			}
+
+			fmt.Printf("Your device has been moved to %s\n", appName)
+			if url, err := api.DeviceUrl(); err == nil {
+				fmt.Printf("\nYou can access the device at:\n%s\n", url)
+			}
+
+			return nil
+		},
+	}
+	cmdMove.Flags().StringVarP(&email, "email", "e", "", "Email address of the account which owns the device (required without --token)")
+	cmdMove.Flags().StringVarP(&password, "password", "p", "", "Password of the account which owns the device (required without --token)")
+	cmdMove.Flags().StringVarP(&token, "token", "t", "", "API token of the account which owns the device, defaults to $RESIN_API_TOKEN")
+	cmdMove.Flags().StringVarP(&appName, "application", "a", "", "Name of application to move the device to (required)")
+	rootCmd.AddCommand(cmdMove)
+
+	cmdApply := &cobra.Command{
+		Use:   "apply [bundle file]",
+		Short: "Provision this device from a provisioning bundle",
+		Long: `
+This command will register this device on resin.io and start the
+Resin Supervisor using a provisioning bundle generated elsewhere with
+'resin-provision bundle create', without needing credentials on the
+device.
+`,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return errors.New("Bundle file is required")
+			}
+
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			api = newApi(configPath)
+
+			bytes, err := ioutil.ReadFile(args[0])
+			if err != nil {
+				return err
+			}
+			bundle, err := provisioner.ParseBundle(string(bytes))
+			if err != nil {
+				return err
+			}
+
+			// Endpoints in the bundle take precedence over the domain.
+			if bundle.ApiEndpoint != "" {
+				api.Domain = ""
+			}
+
+			if dryRun {
+				return printPreview(bundle.ProvisionOpts())
+			}
+			if err := api.ProvisionBundle(bundle); err != nil {
+				return err
+			}
+
+			return printProvisioned()
+		},
+	}
+	rootCmd.AddCommand(cmdApply)
+
+	cmdBundle := &cobra.Command{
+		Use:   "bundle",
+		Short: "Manage provisioning bundles",
+	}
+	cmdBundleCreate := &cobra.Command{
+		Use:   "create [output file]",
+		Short: "Create a provisioning bundle for an application",
+		Long: `
+This command will generate a provisioning bundle for the specified
+application, to be applied on devices with 'resin-provision apply'.
+It can be run on any machine. The bundle contains an API key for the
+application so should be kept safe. If no output file is specified the
+bundle is written to stdout.
+`,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 1 {
+				return errors.New("Only one output file may be specified")
+			} else if err := checkCredentials(token, email, password); err != nil {
+				return err
+			} else if appName == "" {
+				return errors.New("Application is required")
+			}
+
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			endpoint := apiEndpoint()
+			if token, e := getToken(token, email, password); e != nil {
+				return e
+			} else if appId, err := resin.GetAppByName(endpoint, token, appName); err != nil {
+				return err
+			} else if userId, err := resin.GetUserId(token); err != nil {
+				return err
+			} else if userName, err := resin.GetUserName(token); err != nil {
+				return err
+			} else if apiKey, err := resin.GetApiKey(endpoint, appId, token); err != nil {
+				return err
+			} else {
+				var conf provisioner.Config
+				conf.SetDomain(domain)
+				if apiEndpointFlag != "" {
+					conf.ApiEndpoint = apiEndpointFlag
 				}
 
-				// Since we're just returning a device URL no
-				// point in worrying about the error.
-				if url, err := api.DeviceUrl(); err == nil {
-					fmt.Println("Your device is now provisioned and is " +
-						"downloading and installing the resin supervisor.")
-					fmt.Println("Your device will show as configuring during " +
-						"this process, appearing online once it's complete.")
-					fmt.Printf("\nYou can access the device at:\n%s\n", url)
+				bundle := &provisioner.Bundle{
+					ApplicationId:    appId,
+					ApiKey:           apiKey,
+					UserId:           userId,
+					UserName:         userName,
+					DeviceName:       deviceName,
+					ApiEndpoint:      conf.ApiEndpoint,
+					VpnEndpoint:      conf.VpnEndpoint,
+					RegistryEndpoint: conf.RegistryEndpoint,
+					DeltaEndpoint:    conf.DeltaEndpoint,
+				}
+				if str, err := bundle.String(); err != nil {
+					return err
+				} else if len(args) == 0 {
+					fmt.Print(str)
+				} else if err := ioutil.WriteFile(args[0], []byte(str), 0600); err != nil {
+					return err
 				}
 
 				return nil
 			}
 		},
 	}
-	rootCmd.AddCommand(cmdInteractive)
+	cmdBundleCreate.Flags().StringVarP(&email, "email", "e", "", "Email address of the account which owns the application (required without --token)")
+	cmdBundleCreate.Flags().StringVarP(&password, "password", "p", "", "Password of the account which owns the application (required without --token)")
+	cmdBundleCreate.Flags().StringVarP(&token, "token", "t", "", "API token of the account which owns the application, defaults to $RESIN_API_TOKEN")
+	cmdBundleCreate.Flags().StringVarP(&appName, "application", "a", "", "Name of application in which devices will register (required)")
+	cmdBundleCreate.Flags().StringVarP(&deviceName, "device-name", "n", "", "Name to register the device with")
+	cmdBundle.AddCommand(cmdBundleCreate)
+	rootCmd.AddCommand(cmdBundle)
 
 	cmdStatus := &cobra.Command{
 		Use:   "status",
@@ -386,7 +686,89 @@ help you manage device fleets.
 	}
 	rootCmd.AddCommand(cmdStatus)
 
-	if err := rootCmd.Execute(); err != nil {
+	cmdConfig := &cobra.Command{
+		Use:   "config",
+		Short: "Manage the supervisor's config.json",
+	}
+	cmdConfigValidate := &cobra.Command{
+		Use:   "validate",
+		Short: "Check config.json for problems",
+		Long: `
+This command checks config.json for missing or malformed fields which
+would stop the supervisor from starting, reporting every problem found.
+`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			api := provisioner.New(configPath)
+			if err := api.ValidateConfig(); err != nil {
+				if errs, ok := err.(provisioner.ConfigErrors); ok {
+					for _, e := range errs {
+						fmt.Println(e)
+					}
+					return fmt.Errorf("Found %d problem(s) in %s", len(errs), configPath)
+				}
+				return err
+			}
+
+			fmt.Printf("%s is valid\n", configPath)
+			return nil
+		},
+	}
+	cmdConfig.AddCommand(cmdConfigValidate)
+
+	cmdConfigHistory := &cobra.Command{
+		Use:   "history",
+		Short: "List the saved previous versions of config.json",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			api := provisioner.New(configPath)
+			if backups, err := api.ListConfigBackups(); err != nil {
+				return err
+			} else if len(backups) == 0 {
+				fmt.Println("No previous versions of config.json saved")
+			} else {
+				for _, backup := range backups {
+					fmt.Printf("%s\t%s\n", backup.Id, backup.Time.Local().Format(time.RFC1123))
+				}
+			}
+			return nil
+		},
+	}
+	cmdConfig.AddCommand(cmdConfigHistory)
+
+	cmdConfigRestore := &cobra.Command{
+		Use:   "restore [id]",
+		Short: "Restore a previous version of config.json",
+		Long: `
+This command replaces config.json with a previous version listed by
+'config history'. The current config.json is saved first, so a restore can
+itself be undone. Any interrupted provision is discarded.
+`,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return errors.New("Please specify the id of the version to restore.")
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			api := provisioner.New(configPath)
+			if dryRun {
+				fmt.Printf("Ready to restore config.json version %s\n", args[0])
+				return nil
+			} else if err := api.RestoreConfig(args[0]); err != nil {
+				return err
+			}
+
+			fmt.Printf("Restored config.json version %s\n", args[0])
+			return nil
+		},
+	}
+	cmdConfig.AddCommand(cmdConfigRestore)
+	rootCmd.AddCommand(cmdConfig)
+
+	return rootCmd
+}
+
+func main() {
+	if err := newRootCmd().Execute(); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1 +1,87 @@
 package main
+
+import (
+	"io/ioutil"
+	"os"
+	pathLib "path"
+	"testing"
+
+	"github.com/resin-os/resin-provisioner/provisioner"
+	"github.com/resin-os/resin-provisioner/resin/resintest"
+	"github.com/resin-os/resin-provisioner/util"
+)
+
+const testConfig = `{"deviceType": "raspberrypi3", "listenPort": "48484"}`
+
+func runCommand(args ...string) error {
+	cmd := newRootCmd()
+	cmd.SetArgs(args)
+	cmd.SetOutput(ioutil.Discard)
+
+	return cmd.Execute()
+}
+
+func TestProvisionDeprovision(t *testing.T) {
+	server := resintest.NewServer()
+	defer server.Close()
+	userId, token := server.AddUser("user@example.com", "password")
+	// Applications are listed for this device's type.
+	deviceType, err := util.ScanDeviceTypeSlug(util.OSRELEASE_PATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.AddApplication(userId, "test", deviceType)
+
+	dir, err := ioutil.TempDir("", "resin-provision")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configPath := pathLib.Join(dir, "config.json")
+	if err := ioutil.WriteFile(configPath, []byte(testConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	servicesPath := pathLib.Join(dir, "resin-connectable.conf")
+	if err := ioutil.WriteFile(servicesPath, []byte("resin-supervisor.service\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	prevPath, prevServices := provisioner.ResinServicesPath, serviceManager
+	defer func() { provisioner.ResinServicesPath, serviceManager = prevPath, prevServices }()
+	provisioner.ResinServicesPath = servicesPath
+	fake := provisioner.NewFakeServiceManager()
+	serviceManager = fake
+
+	state := func() provisioner.ProvisionedState {
+		state, err := provisioner.New(configPath).State()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return state
+	}
+
+	if err := runCommand("provision", "--config", configPath, "--api-endpoint", server.URL,
+		"--token", token, "--application", "test"); err != nil {
+		t.Fatalf("provision failed: %s", err)
+	} else if s := state(); s != provisioner.Provisioned {
+		t.Fatalf("Unexpected state %s after provision", s)
+	} else if n := server.DeviceCount(); n != 1 {
+		t.Fatalf("Expected 1 registered device, got %d", n)
+	}
+
+	if err := runCommand("deprovision", "--config", configPath); err != nil {
+		t.Fatalf("deprovision failed: %s", err)
+	} else if s := state(); s != provisioner.Unprovisioned {
+		t.Errorf("Unexpected state %s after deprovision", s)
+	}
+
+	stopped := false
+	for _, call := range fake.Calls {
+		if call == "stop resin-supervisor.service" {
+			stopped = true
+		}
+	}
+	if !stopped {
+		t.Errorf("Supervisor not stopped on deprovision, calls: %v", fake.Calls)
+	}
+}
@@ -1,10 +1,15 @@
 package provisioner
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/resin-os/resin-provisioner/resin"
@@ -15,8 +20,56 @@ type ProvisionedState int
 type Api struct {
 	ConfigPath string
 	Domain     string
-	listener   net.Listener
-	server     *http.Server
+	// The services to enable on provisioning, systemd if not set.
+	Services ServiceManager
+	// Used for requests to the Resin API, a default with a timeout if not
+	// set.
+	HTTPClient *http.Client
+	// Callers allowed to use routes which change the device's state, any
+	// if nil.
+	Auth *PeerAuth
+	// Permissions given to the socket by Serve. A zero mode or negative
+	// ids leave those set on creation, the socket only being accessible
+	// by its owner.
+	SocketMode os.FileMode
+	SocketUid  int
+	SocketGid  int
+	// If set, Serve closes the server after this long without requests.
+	IdleTimeout time.Duration
+
+	listener net.Listener
+	server   *http.Server
+
+	idleMutex   sync.Mutex
+	activeConns map[net.Conn]bool
+	lastActive  time.Time
+
+	// Cancelled to abort in-flight requests to the Resin API.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Closed when Shutdown starts and finishes respectively.
+	stopping     chan struct{}
+	stopped      chan struct{}
+	shutdownOnce sync.Once
+	shutdownErr  error
+	// Operations which must finish for config.json to be left consistent.
+	criticalMutex sync.Mutex
+	critical      sync.WaitGroup
+	// Held while changing config.json or the device's registration.
+	lockMutex sync.Mutex
+	locked    bool
+
+	eventsMutex sync.Mutex
+	subscribers map[chan Event]bool
+	// The state last reported to subscribers.
+	lastState ProvisionedState
+	// The job emitted events come from, if any.
+	eventJob string
+
+	// Background provisions, oldest first.
+	jobsMutex sync.Mutex
+	jobs      []*Job
 }
 
 type ProvisionOpts struct {
@@ -24,6 +77,56 @@ type ProvisionOpts struct {
 	UserName      string `json:"username"`
 	ApplicationId string `json:"applicationId"`
 	ApiKey        string `json:"apikey"`
+	// Optional name to register the device with, otherwise the API picks
+	// one.
+	DeviceName string `json:"deviceName,omitempty"`
+	// Optional endpoints overriding those derived from the domain.
+	ApiEndpoint      string `json:"apiEndpoint,omitempty"`
+	VpnEndpoint      string `json:"vpnEndpoint,omitempty"`
+	RegistryEndpoint string `json:"registryEndpoint,omitempty"`
+	DeltaEndpoint    string `json:"deltaEndpoint,omitempty"`
+	// Reset a partially provisioned device rather than resuming.
+	Force bool `json:"force"`
+}
+
+// Checks the options are sane before we attempt to provision with them.
+func (o *ProvisionOpts) Validate() error {
+	if !isInteger(o.UserId) || !isInteger(o.ApplicationId) ||
+		!isValidApiKey(o.ApiKey) {
+		return newError(ErrorInvalidOptions, "Invalid options.")
+	}
+
+	for _, url := range []string{o.ApiEndpoint, o.DeltaEndpoint} {
+		if url != "" && !isValidUrl(url) {
+			return newError(ErrorInvalidOptions, "Invalid endpoint URL %s.", url)
+		}
+	}
+	for _, host := range []string{o.VpnEndpoint, o.RegistryEndpoint} {
+		if host != "" && !isValidHost(host) {
+			return newError(ErrorInvalidOptions, "Invalid endpoint host %s.", host)
+		}
+	}
+
+	return nil
+}
+
+func (o *ProvisionOpts) applyEndpoints(c *Config) {
+	if o.ApiEndpoint != "" {
+		c.ApiEndpoint = o.ApiEndpoint
+	}
+	if o.VpnEndpoint != "" {
+		c.VpnEndpoint = o.VpnEndpoint
+	}
+	if o.RegistryEndpoint != "" {
+		c.RegistryEndpoint = o.RegistryEndpoint
+	}
+	if o.DeltaEndpoint != "" {
+		c.DeltaEndpoint = o.DeltaEndpoint
+	}
+}
+
+type DeprovisionOpts struct {
+	RotateUuid bool `json:"rotateUuid"`
 }
 
 const (
@@ -31,6 +134,9 @@ const (
 	Unprovisioned
 	Provisioning
 	Provisioned
+	// Registered and config.json written, but the supervisor services have
+	// not yet all been enabled and started.
+	RegisteredNotStarted
 )
 
 func (s ProvisionedState) String() string {
@@ -43,24 +149,51 @@ func (s ProvisionedState) String() string {
 		return "provisioning"
 	case Provisioned:
 		return "provisioned"
+	case RegisteredNotStarted:
+		return "registered_not_started"
 	}
 
 	return "invalid"
 }
 
 func New(configPath string) *Api {
-	ret := &Api{ConfigPath: configPath}
+	ret := &Api{ConfigPath: configPath, SocketUid: -1, SocketGid: -1,
+		stopping: make(chan struct{}), stopped: make(chan struct{})}
+	ret.ctx, ret.cancel = context.WithCancel(context.Background())
 	ret.initServer()
 
 	return ret
 }
 
+// Aborts any in-flight requests to the Resin API, causing the operations
+// making them to fail. The Api can't make further requests after this.
+func (a *Api) Cancel() {
+	a.cancel()
+}
+
+// Returns a client for the Resin API the config points at, authenticated with
+// its API key.
+func (a *Api) resinClient(conf *Config) *resin.Client {
+	client := resin.NewClient(conf.ApiEndpoint).WithApiKey(conf.ApiKey)
+	if a.HTTPClient != nil {
+		client.HTTPClient = a.HTTPClient
+	}
+
+	return client
+}
+
 // Returns the device provisioned state.
 func (a *Api) State() (ProvisionedState, error) {
 	if conf, err := a.readConfig(); err != nil {
 		return Unknown, fmt.Errorf("Cannot read config: %s", err)
+	} else if state := conf.ProvisionedState(); state != Provisioned {
+		return state, nil
+	} else if j, err := a.readJournal(); err != nil {
+		return Unknown, fmt.Errorf("Cannot read journal: %s", err)
+	} else if j.exists() && !j.allDone(serviceSteps) {
+		return RegisteredNotStarted, nil
 	} else {
-		return conf.ProvisionedState(), nil
+		return Provisioned, nil
 	}
 }
 
@@ -74,48 +207,292 @@ func (a *Api) StateJson() (ret string, err error) {
 	return
 }
 
+// Provisions the device, registering it and then enabling and starting the
+// supervisor services. If registration succeeded but the services could not be
+// started the returned error is a *SupervisorError. Fails with a conflict if
+// another provision is in progress.
 func (a *Api) Provision(opts *ProvisionOpts) error {
+	return a.withLock(func() error { return a.provision(opts) })
+}
+
+func (a *Api) provision(opts *ProvisionOpts) error {
 	if state, err := a.State(); err != nil {
 		return err
 	} else if state == Provisioned {
 		return nil
+	} else if state == RegisteredNotStarted {
+		return a.startSupervisor()
+	} else if state == Provisioning && !opts.Force {
+		// A previous attempt was interrupted, pick up where it left off,
+		// unless it was for someone else's application as opts would be
+		// ignored.
+		if conf, err := a.readConfig(); err != nil {
+			return fmt.Errorf("Cannot read config: %s", err)
+		} else if conf.ApplicationId != opts.ApplicationId || conf.UserId != opts.UserId {
+			return newError(ErrorConflict,
+				"Device is provisioning for application %s, use force to start again.",
+				conf.ApplicationId)
+		}
+		return a.resume()
+	} else if state != Unprovisioned && state != Provisioning {
+		return newError(ErrorConflict, "Cannot provision, device is %s.", state)
+	}
+
+	conf, err := a.provisionConfig(opts)
+	if err != nil {
+		return err
+	}
+
+	// Any journal left over from a previous provision is stale.
+	j, err := a.newJournal()
+	if err != nil {
+		return err
+	}
+
+	// Ok, now we go for it.
+	j.DeviceName = opts.DeviceName
+	if err := a.runConfigSteps(conf, j); err != nil {
+		return err
+	}
+
+	return a.startSupervisor()
+}
+
+// Returns the config a fresh provision with opts starts from, before anything
+// is fetched from the Resin API.
+func (a *Api) provisionConfig(opts *ProvisionOpts) (*Config, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	conf, err := a.readConfig()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read config: %s", err)
+	}
+
+	// First check to see whether config.json has changed from underneath
+	// us.
+	state := conf.ProvisionedState()
+	if state == Provisioning && opts.Force {
+		// Throw away the partial state, including the uuid as it may
+		// already be registered elsewhere.
+		conf.ClearProvisioning(true)
 	} else if state != Unprovisioned {
-		return fmt.Errorf("Cannot provision, device is %s.", state)
+		return nil, newError(ErrorConflict, "Cannot provision, device is %s.", state)
 	}
 
-	if !isInteger(opts.UserId) || !isInteger(opts.ApplicationId) ||
-		!isValidApiKey(opts.ApiKey) {
-		return fmt.Errorf("Invalid options.")
+	conf.UserId = opts.UserId
+	conf.UserName = opts.UserName
+	conf.ApplicationId = opts.ApplicationId
+	conf.ApiKey = opts.ApiKey
+	opts.applyEndpoints(conf)
+
+	return conf, nil
+}
+
+// Completes a provision which was interrupted, reusing the stored uuid so an
+// existing registration is picked up rather than duplicated, then starts the
+// supervisor.
+func (a *Api) Resume() error {
+	return a.withLock(a.resume)
+}
+
+func (a *Api) resume() error {
+	conf, err := a.readConfig()
+	if err != nil {
+		return fmt.Errorf("Cannot read config: %s", err)
+	} else if state := conf.ProvisionedState(); state == Provisioned {
+		// Registered, but the supervisor may not have been started.
+		return a.startSupervisor()
+	} else if state != Provisioning {
+		return newError(ErrorConflict, "Cannot resume, device is %s.", state)
 	}
 
+	if j, err := a.readJournal(); err != nil {
+		return fmt.Errorf("Cannot read journal: %s", err)
+	} else if err := a.runConfigSteps(conf, j); err != nil {
+		return err
+	}
+
+	return a.startSupervisor()
+}
+
+func (a *Api) runConfigSteps(conf *Config, j *journal) error {
+	return runSteps(j, configSteps, a.trackSteps(func(step ProvisionStep) error {
+		switch step {
+		case StepFetchKeys:
+			if err := conf.GetKeysFromClient(a.ctx, a.resinClient(conf)); err != nil {
+				return resinApiError(err)
+			}
+
+			// Persist the uuid before registering so that a retry
+			// picks up the same device.
+			if conf.Uuid == "" {
+				if uuid, err := randomHexString(UUID_BYTE_LENGTH); err != nil {
+					return err
+				} else {
+					conf.Uuid = uuid
+				}
+			}
+
+			return a.writeConfig(conf)
+		case StepRegisterDevice:
+			if err := a.registerDevice(conf, j.DeviceName); err != nil {
+				return resinApiError(err)
+			}
+
+			j.DeviceId = conf.DeviceId
+			j.RegisteredAt = conf.RegisteredAt
+			return nil
+		case StepWriteConfig:
+			conf.DeviceId = j.DeviceId
+			conf.RegisteredAt = j.RegisteredAt
+			return a.writeConfig(conf)
+		}
+
+		return fmt.Errorf("Unknown step %s.", step)
+	}))
+}
+
+// Enables and starts the supervisor services on a provisioned device,
+// skipping any steps completed by a previous attempt. Failures to do so are
+// returned as a *SupervisorError.
+func (a *Api) StartSupervisor() error {
+	return a.withLock(a.startSupervisor)
+}
+
+func (a *Api) startSupervisor() error {
 	if conf, err := a.readConfig(); err != nil {
 		return fmt.Errorf("Cannot read config: %s", err)
+	} else if state := conf.ProvisionedState(); state != Provisioned {
+		return newError(ErrorConflict, "Cannot start supervisor, device is %s.", state)
+	}
+
+	j, err := a.readJournal()
+	if err != nil {
+		return fmt.Errorf("Cannot read journal: %s", err)
+	}
+
+	if services, release, err := a.services(); err != nil {
+		return err
 	} else {
-		// First check to see whether config.json has changed from
-		// underneath us.
-		if state := conf.ProvisionedState(); state != Unprovisioned {
-			return fmt.Errorf("Cannot provision, device is %s.", state)
-		}
+		defer release()
 
-		// Ok, now we go for it.
-		conf.UserId = opts.UserId
-		conf.UserName = opts.UserName
-		conf.ApplicationId = opts.ApplicationId
-		conf.ApiKey = opts.ApiKey
-		if err := conf.GetKeysFromApi(); err != nil {
+		run := func(step ProvisionStep) error {
+			if err := runServiceStep(services, step); err != nil {
+				return &SupervisorError{Step: step, Err: err}
+			}
+			return nil
+		}
+		if err := runSteps(j, serviceSteps, a.trackSteps(run)); err != nil {
+			a.emit(Event{Type: EventSupervisor, Status: EventFailed,
+				Error: eventError(err)})
 			return err
 		}
+	}
+	a.emit(Event{Type: EventSupervisor, Status: EventStarted})
 
-		if err := a.RegisterDevice(conf); err != nil {
-			return err
+	// We're done, nothing left to resume.
+	return j.remove()
+}
+
+// Returns the device to the unprovisioned state, stopping and disabling the
+// supervisor services and clearing provisioning data from config.json.
+func (a *Api) Deprovision(opts *DeprovisionOpts) error {
+	return a.withLock(func() error { return a.deprovision(opts) })
+}
+
+func (a *Api) deprovision(opts *DeprovisionOpts) error {
+	conf, err := a.readConfig()
+	if err != nil {
+		return fmt.Errorf("Cannot read config: %s", err)
+	} else if conf.ProvisionedState() == Unprovisioned {
+		return nil
+	}
+
+	// Stop the supervisor before we pull config.json from underneath it.
+	if services, release, err := a.services(); err != nil {
+		return err
+	} else {
+		defer release()
+
+		if err := SupervisorStopDisable(services); err != nil {
+			return fmt.Errorf("Cannot stop supervisor: %s", err)
 		}
+	}
 
-		return a.writeConfig(conf)
+	conf.ClearProvisioning(opts.RotateUuid)
+	if err := a.writeConfig(conf); err != nil {
+		return err
+	}
+
+	if j, err := a.readJournal(); err != nil {
+		return err
+	} else {
+		return j.remove()
+	}
+}
+
+// Moves a provisioned device to the application with the specified ID,
+// using the user's token to update the device and generate a new API key.
+func (a *Api) MoveToApplication(appId, token string) error {
+	return a.withLock(func() error { return a.moveToApplication(appId, token) })
+}
+
+func (a *Api) moveToApplication(appId, token string) error {
+	if !isInteger(appId) {
+		return newError(ErrorInvalidOptions, "Invalid application ID.")
+	}
+
+	conf, err := a.readConfig()
+	if err != nil {
+		return fmt.Errorf("Cannot read config: %s", err)
+	} else if state := conf.ProvisionedState(); state != Provisioned {
+		return newError(ErrorConflict, "Cannot move, device is %s.", state)
+	} else if conf.ApplicationId == appId {
+		return nil
+	}
+
+	client := a.resinClient(conf).WithToken(token)
+	deviceId := conf.DeviceId
+	if deviceId == 0 {
+		if deviceId, err = client.GetDeviceId(a.ctx, conf.Uuid); err != nil {
+			return resinApiError(err)
+		}
+	}
+
+	if err := client.MoveDevice(a.ctx, deviceId, appId); err != nil {
+		return resinApiError(err)
+	}
+
+	if apiKey, err := client.GetApiKey(a.ctx, appId); err != nil {
+		return resinApiError(err)
+	} else {
+		conf.ApplicationId = appId
+		conf.ApiKey = apiKey
+		conf.DeviceId = deviceId
+	}
+
+	if err := a.writeConfig(conf); err != nil {
+		return err
+	}
+
+	// Restart the supervisor so it picks up the new configuration.
+	if services, release, err := a.services(); err != nil {
+		return err
+	} else {
+		defer release()
+
+		return services.RestartUnit(SUPERVISOR_PATH)
 	}
 }
 
 // TODO: Use proper pinejs client for all this.
-func (a Api) RegisterDevice(c *Config) error {
+func (a *Api) RegisterDevice(c *Config) error {
+	return a.registerDevice(c, "")
+}
+
+func (a *Api) registerDevice(c *Config, name string) error {
 	registeredAt := time.Now().Unix()
 	if c.Uuid == "" {
 		if uuid, err := randomHexString(UUID_BYTE_LENGTH); err != nil {
@@ -131,8 +508,11 @@ func (a Api) RegisterDevice(c *Config) error {
 	device["uuid"] = c.Uuid
 	device["device_type"] = c.DeviceType
 	device["registered_at"] = registeredAt
+	if name != "" {
+		device["name"] = name
+	}
 
-	err := resin.CreateOrGetDevice(c.ApiEndpoint, &device, c.ApiKey)
+	err := a.resinClient(c).CreateOrGetDevice(a.ctx, &device)
 	if err != nil {
 		return err
 	}
@@ -146,24 +526,82 @@ func (a Api) RegisterDevice(c *Config) error {
 }
 
 func (a *Api) ConfigJson() (string, error) {
-	if conf, err := a.readConfig(); err != nil {
+	return a.configJson(false)
+}
+
+// Returns config.json with the values of sensitive fields redacted.
+func (a *Api) RedactedConfigJson() (string, error) {
+	return a.configJson(true)
+}
+
+func (a *Api) configJson(redact bool) (string, error) {
+	conf, err := a.readConfig()
+	if err != nil {
 		return "", fmt.Errorf("Cannot read config: %s", err)
-	} else if str, err := stringifyConfig(conf); err != nil {
+	} else if redact {
+		conf = conf.Redacted()
+	}
+
+	if str, err := stringifyConfig(conf); err != nil {
 		return "", fmt.Errorf("Cannot stringfy config: %s", err)
 	} else {
 		return str, nil
 	}
 }
 
+type DeviceInfo struct {
+	Id   int64  `json:"id"`
+	Uuid string `json:"uuid"`
+	// Empty if the dashboard isn't known for the API endpoint.
+	Url string `json:"url,omitempty"`
+}
+
+// Returns details of the registered device.
+func (a *Api) Device() (*DeviceInfo, error) {
+	conf, err := a.readConfig()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read config: %s", err)
+	} else if err := checkRegistered(conf); err != nil {
+		return nil, err
+	}
+
+	ret := &DeviceInfo{Id: conf.DeviceId, Uuid: conf.Uuid}
+	if url, err := deviceUrl(conf); err == nil {
+		ret.Url = url
+	}
+
+	return ret, nil
+}
+
+// Returns the device's page on the dashboard, failing if the API endpoint
+// isn't of the form https://api.<domain> the dashboard's host is derived from.
 func (a *Api) DeviceUrl() (string, error) {
 	if conf, err := a.readConfig(); err != nil {
 		return "", fmt.Errorf("Cannot read config: %s", err)
-	} else if conf.ApplicationId == "" {
-		return "", fmt.Errorf("Empty application ID.")
+	} else if err := checkRegistered(conf); err != nil {
+		return "", err
+	} else {
+		return deviceUrl(conf)
+	}
+}
+
+func checkRegistered(conf *Config) error {
+	if conf.ApplicationId == "" {
+		return fmt.Errorf("Empty application ID.")
 	} else if conf.DeviceId == 0 {
-		return "", fmt.Errorf("Empty device ID.")
+		return fmt.Errorf("Empty device ID.")
+	}
+
+	return nil
+}
+
+func deviceUrl(conf *Config) (string, error) {
+	if endpoint, err := url.Parse(conf.ApiEndpoint); err != nil {
+		return "", fmt.Errorf("Invalid API endpoint %q: %s", conf.ApiEndpoint, err)
+	} else if !strings.HasPrefix(endpoint.Host, "api.") || endpoint.Host == "api." {
+		return "", fmt.Errorf("No dashboard known for API endpoint %q.", conf.ApiEndpoint)
 	} else {
 		return fmt.Sprintf("https://dashboard.%s/apps/%s/devices/%d/summary",
-			a.Domain, conf.ApplicationId, conf.DeviceId), nil
+			strings.TrimPrefix(endpoint.Host, "api."), conf.ApplicationId, conf.DeviceId), nil
 	}
 }
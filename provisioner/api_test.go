@@ -0,0 +1,407 @@
+package provisioner
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/resin-os/resin-provisioner/resin"
+	"github.com/resin-os/resin-provisioner/resin/resintest"
+)
+
+// Returns options for provisioning against a fresh fake API server.
+func newTestServer(t *testing.T) (*resintest.Server, *ProvisionOpts) {
+	server := resintest.NewServer()
+	userId, _ := server.AddUser("user@example.com", "password")
+	appId := server.AddApplication(userId, "test", "raspberrypi3")
+
+	opts := &ProvisionOpts{
+		UserId:        strconv.FormatInt(userId, 10),
+		UserName:      "user",
+		ApplicationId: strconv.FormatInt(appId, 10),
+		ApiKey:        server.AddApiKey(appId),
+		ApiEndpoint:   server.URL,
+	}
+
+	return server, opts
+}
+
+func TestProvision(t *testing.T) {
+	defer withResinServices(t, "resin-supervisor.service\n")()
+	server, opts := newTestServer(t)
+	defer server.Close()
+	api, cleanup := newTestApi(t)
+	defer cleanup()
+
+	if err := api.Provision(opts); err != nil {
+		t.Fatalf("Provision failed: %s", err)
+	}
+
+	if state, err := api.State(); err != nil {
+		t.Fatal(err)
+	} else if state != Provisioned {
+		t.Errorf("Unexpected state %s after provisioning", state)
+	}
+
+	conf, err := api.readConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device := server.Device(conf.Uuid); device == nil {
+		t.Error("Device not registered")
+	} else if id, _ := device["id"].(int64); id != conf.DeviceId {
+		t.Errorf("Device id %d doesn't match registered device %d", conf.DeviceId, id)
+	}
+	if conf.MixpanelToken != resintest.MixpanelToken {
+		t.Errorf("Unexpected mixpanel token %q", conf.MixpanelToken)
+	}
+}
+
+func TestProvisionResumesAfterApiFailure(t *testing.T) {
+	defer withResinServices(t, "resin-supervisor.service\n")()
+	server, opts := newTestServer(t)
+	defer server.Close()
+	api, cleanup := newTestApi(t)
+	defer cleanup()
+
+	server.Inject(resintest.Fault{Method: "POST", Path: "/v1/device", Status: 400})
+	if err := api.Provision(opts); errorCode(err) != ErrorResinApi {
+		t.Fatalf("Expected resin API error, got %v", err)
+	} else if state, _ := api.State(); state != Provisioning {
+		t.Fatalf("Unexpected state %s after failure", state)
+	}
+
+	server.ClearFaults()
+	if err := api.Resume(); err != nil {
+		t.Fatalf("Resume failed: %s", err)
+	} else if state, _ := api.State(); state != Provisioned {
+		t.Errorf("Unexpected state %s after resuming", state)
+	} else if n := server.DeviceCount(); n != 1 {
+		t.Errorf("Expected 1 registered device, got %d", n)
+	}
+}
+
+func TestProvisionResumesOnlySameApplication(t *testing.T) {
+	defer withResinServices(t, "resin-supervisor.service\n")()
+	server, opts := newTestServer(t)
+	defer server.Close()
+	api, cleanup := newTestApi(t)
+	defer cleanup()
+
+	server.Inject(resintest.Fault{Method: "POST", Path: "/v1/device", Status: 400})
+	if err := api.Provision(opts); errorCode(err) != ErrorResinApi {
+		t.Fatalf("Expected resin API error, got %v", err)
+	}
+	server.ClearFaults()
+
+	userId, _ := strconv.ParseInt(opts.UserId, 10, 64)
+	otherAppId := server.AddApplication(userId, "other", "raspberrypi3")
+	other := *opts
+	other.ApplicationId = strconv.FormatInt(otherAppId, 10)
+	other.ApiKey = server.AddApiKey(otherAppId)
+	if err := api.Provision(&other); errorCode(err) != ErrorConflict {
+		t.Errorf("Expected conflict provisioning for another application, got %v", err)
+	} else if state, _ := api.State(); state != Provisioning {
+		t.Errorf("Unexpected state %s after conflict", state)
+	}
+
+	// Provisioning again with the same options resumes.
+	if err := api.Provision(opts); err != nil {
+		t.Fatalf("Resuming provision failed: %s", err)
+	} else if state, _ := api.State(); state != Provisioned {
+		t.Errorf("Unexpected state %s after resuming", state)
+	} else if n := server.DeviceCount(); n != 1 {
+		t.Errorf("Expected 1 registered device, got %d", n)
+	}
+}
+
+func TestProvisionForceDiscardsInterrupted(t *testing.T) {
+	defer withResinServices(t, "resin-supervisor.service\n")()
+	server, opts := newTestServer(t)
+	defer server.Close()
+	api, cleanup := newTestApi(t)
+	defer cleanup()
+
+	server.Inject(resintest.Fault{Method: "POST", Path: "/v1/device", Status: 400})
+	if err := api.Provision(opts); errorCode(err) != ErrorResinApi {
+		t.Fatalf("Expected resin API error, got %v", err)
+	}
+	server.ClearFaults()
+	interrupted, err := api.readConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userId, _ := strconv.ParseInt(opts.UserId, 10, 64)
+	otherAppId := server.AddApplication(userId, "other", "raspberrypi3")
+	other := *opts
+	other.ApplicationId = strconv.FormatInt(otherAppId, 10)
+	other.ApiKey = server.AddApiKey(otherAppId)
+	other.Force = true
+	if err := api.Provision(&other); err != nil {
+		t.Fatalf("Forced provision failed: %s", err)
+	}
+
+	conf, err := api.readConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.ApplicationId != other.ApplicationId || conf.ApiKey != other.ApiKey {
+		t.Errorf("Config not for the new application: %s %s", conf.ApplicationId, conf.ApiKey)
+	} else if conf.Uuid == interrupted.Uuid {
+		t.Error("Uuid of interrupted provision reused")
+	} else if device := server.Device(conf.Uuid); device == nil {
+		t.Error("Device not registered")
+	}
+}
+
+// Provisions a fresh Api against a fresh fake API server, with a field the
+// provisioner doesn't know about in config.json.
+func newProvisionedApi(t *testing.T) (*Api, *resintest.Server, *ProvisionOpts, func()) {
+	server, opts := newTestServer(t)
+	api, cleanup := newTestApi(t)
+
+	content := strings.Replace(minimalJson, "{", `{"customField": "keep",`, 1)
+	if err := ioutil.WriteFile(api.ConfigPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	} else if err := api.Provision(opts); err != nil {
+		t.Fatalf("Provision failed: %s", err)
+	}
+
+	return api, server, opts, func() {
+		server.Close()
+		cleanup()
+	}
+}
+
+func TestDeprovision(t *testing.T) {
+	defer withResinServices(t, "resin-supervisor.service\n")()
+	api, _, _, cleanup := newProvisionedApi(t)
+	defer cleanup()
+	before, err := api.readConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A journal left by a previous provision.
+	if err := ioutil.WriteFile(api.journalPath(), []byte(`{"completed": []}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fake := api.Services.(*FakeServiceManager)
+	fake.Calls = nil
+
+	if err := api.Deprovision(&DeprovisionOpts{}); err != nil {
+		t.Fatalf("Deprovision failed: %s", err)
+	}
+
+	for _, call := range []string{
+		"stop update-resin-supervisor.timer",
+		"stop resin-supervisor.service",
+		"disable resin-supervisor.service",
+		"disable update-resin-supervisor.timer",
+	} {
+		found := false
+		for _, c := range fake.Calls {
+			found = found || c == call
+		}
+		if !found {
+			t.Errorf("Expected %q, got calls %v", call, fake.Calls)
+		}
+	}
+
+	conf, err := api.readConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := conf.ProvisionedState(); state != Unprovisioned {
+		t.Errorf("Unexpected state %s after deprovision", state)
+	}
+	if conf.ApplicationId != "" || conf.ApiKey != "" || conf.UserId != "" || conf.UserName != "" ||
+		conf.DeviceId != 0 || conf.RegisteredAt != 0 {
+		t.Errorf("Provisioning fields not cleared: %+v", conf)
+	} else if conf.Uuid != before.Uuid {
+		t.Errorf("Uuid changed from %s to %s without rotating", before.Uuid, conf.Uuid)
+	}
+
+	if content, err := ioutil.ReadFile(api.ConfigPath); err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(string(content), `"customField": "keep"`) ||
+		!strings.Contains(string(content), `"ListenPort":"1234"`) {
+		t.Errorf("Unrelated fields not preserved: %s", content)
+	}
+	if _, err := os.Stat(api.journalPath()); !os.IsNotExist(err) {
+		t.Errorf("Journal not removed: %v", err)
+	}
+}
+
+func TestDeprovisionRotateUuid(t *testing.T) {
+	defer withResinServices(t, "resin-supervisor.service\n")()
+	api, server, opts, cleanup := newProvisionedApi(t)
+	defer cleanup()
+	before, err := api.readConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := api.Deprovision(&DeprovisionOpts{RotateUuid: true}); err != nil {
+		t.Fatalf("Deprovision failed: %s", err)
+	} else if err := api.Provision(opts); err != nil {
+		t.Fatalf("Provision failed: %s", err)
+	}
+
+	if conf, err := api.readConfig(); err != nil {
+		t.Fatal(err)
+	} else if conf.Uuid == "" || conf.Uuid == before.Uuid {
+		t.Errorf("Uuid not rotated: %q", conf.Uuid)
+	} else if n := server.DeviceCount(); n != 2 {
+		t.Errorf("Expected 2 registered devices, got %d", n)
+	}
+}
+
+func TestDeprovisionRoute(t *testing.T) {
+	defer withResinServices(t, "resin-supervisor.service\n")()
+
+	for _, body := range []string{"", `{"rotateUuid": true}`} {
+		api, _, _, cleanup := newProvisionedApi(t)
+		before, err := api.readConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if status, resp := doRequest(t, api, "DELETE", "/provision", body); status != http.StatusOK {
+			t.Errorf("%q: unexpected status %d %+v", body, status, resp)
+		} else if resp.State != Unprovisioned.String() {
+			t.Errorf("%q: unexpected state %s", body, resp.State)
+		} else if conf, err := api.readConfig(); err != nil {
+			t.Fatal(err)
+		} else if rotated := conf.Uuid != before.Uuid; rotated != (body != "") {
+			t.Errorf("%q: uuid rotated %v", body, rotated)
+		}
+
+		cleanup()
+	}
+}
+
+func TestMoveToApplication(t *testing.T) {
+	defer withResinServices(t, "resin-supervisor.service\n")()
+	api, server, opts, cleanup := newProvisionedApi(t)
+	defer cleanup()
+	before, err := api.readConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := resin.Login(server.URL, "user@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := api.MoveToApplication("abc", token); errorCode(err) != ErrorInvalidOptions {
+		t.Errorf("Expected invalid options moving to a non-integer app, got %v", err)
+	}
+
+	// Someone else's application.
+	otherUserId, _ := server.AddUser("other@example.com", "password")
+	otherAppId := server.AddApplication(otherUserId, "theirs", "raspberrypi3")
+	content, err := ioutil.ReadFile(api.ConfigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := api.MoveToApplication(strconv.FormatInt(otherAppId, 10), token); err == nil {
+		t.Error("Moved to an inaccessible application")
+	} else if after, err := ioutil.ReadFile(api.ConfigPath); err != nil {
+		t.Fatal(err)
+	} else if string(after) != string(content) {
+		t.Errorf("Config rewritten despite failed move: %s", after)
+	}
+
+	userId, _ := strconv.ParseInt(opts.UserId, 10, 64)
+	appId := server.AddApplication(userId, "other", "raspberrypi3")
+	fake := api.Services.(*FakeServiceManager)
+	fake.Calls = nil
+	if err := api.MoveToApplication(strconv.FormatInt(appId, 10), token); err != nil {
+		t.Fatalf("Move failed: %s", err)
+	}
+
+	if device := server.Device(before.Uuid); device == nil {
+		t.Fatal("Device not found")
+	} else if id, ok := refId(device["application"]); !ok || id != appId {
+		t.Errorf("Device application not updated: %v", device["application"])
+	}
+	if conf, err := api.readConfig(); err != nil {
+		t.Fatal(err)
+	} else if conf.ApplicationId != strconv.FormatInt(appId, 10) {
+		t.Errorf("Unexpected application %s in config", conf.ApplicationId)
+	} else if conf.ApiKey == "" || conf.ApiKey == before.ApiKey {
+		t.Errorf("New API key not written, got %q", conf.ApiKey)
+	}
+	if len(fake.Calls) != 1 || fake.Calls[0] != "restart resin-supervisor.service" {
+		t.Errorf("Expected supervisor restart, got calls %v", fake.Calls)
+	}
+}
+
+// Returns the id of an object referenced as the fake API renders it.
+func refId(v interface{}) (int64, bool) {
+	if ref, ok := v.(map[string]interface{}); ok {
+		id, ok := ref["__id"].(int64)
+		return id, ok
+	}
+
+	return 0, false
+}
+
+func TestDeviceUrl(t *testing.T) {
+	api, cleanup := newTestApi(t)
+	defer cleanup()
+
+	for endpoint, expected := range map[string]string{
+		"https://api.resin.io":         "https://dashboard.resin.io/apps/1/devices/7/summary",
+		"https://api.resinstaging.io/": "https://dashboard.resinstaging.io/apps/1/devices/7/summary",
+		"http://127.0.0.1:1":           "",
+		"":                             "",
+	} {
+		conf := `{"applicationId": "1", "deviceId": 7, "apiEndpoint": "` + endpoint + `"}`
+		if err := ioutil.WriteFile(api.ConfigPath, []byte(conf), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		url, err := api.DeviceUrl()
+		if expected == "" && err == nil {
+			t.Errorf("%q: expected error, got %s", endpoint, url)
+		} else if expected != "" && url != expected {
+			t.Errorf("%q: expected %s, got %s (%v)", endpoint, expected, url, err)
+		}
+	}
+}
+
+func TestRegisterDevice(t *testing.T) {
+	server, opts := newTestServer(t)
+	defer server.Close()
+	api, cleanup := newTestApi(t)
+	defer cleanup()
+
+	c := Config{DeviceType: "intel-edison", ApplicationId: opts.ApplicationId, ApiKey: opts.ApiKey,
+		UserId: opts.UserId, ApiEndpoint: server.URL}
+	if err := api.RegisterDevice(&c); err != nil {
+		t.Fatal(err)
+	} else if c.RegisteredAt == 0 {
+		t.Error("RegisteredAt not written to config")
+	} else if c.DeviceId == 0 {
+		t.Error("DeviceId not written to config")
+	}
+
+	// An already registered device is reused.
+	c2 := Config{DeviceType: "intel-edison", ApplicationId: opts.ApplicationId, ApiKey: opts.ApiKey,
+		UserId: opts.UserId, ApiEndpoint: server.URL, Uuid: c.Uuid}
+	if err := api.RegisterDevice(&c2); err != nil {
+		t.Error(err)
+	} else if c.DeviceId != c2.DeviceId {
+		t.Error("Device ids don't match when using the same uuid")
+	} else if c2.RegisteredAt == 0 {
+		t.Error("RegisteredAt not written to config when using same uuid")
+	} else if n := server.DeviceCount(); n != 1 {
+		t.Errorf("Expected 1 registered device, got %d", n)
+	}
+}
@@ -0,0 +1,117 @@
+package provisioner
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/resin-os/resin-provisioner/util"
+)
+
+// A previous version of config.json, saved before it was overwritten.
+type ConfigBackup struct {
+	Id   string    `json:"id"`
+	Time time.Time `json:"time"`
+	path string
+}
+
+func (a *Api) backupPrefix() string {
+	return a.ConfigPath + CONFIG_BACKUP_SUFFIX
+}
+
+// Saves the current config.json as a backup, unless it is unchanged from
+// content, then removes all but the newest CONFIG_BACKUP_COUNT backups.
+func (a *Api) backupConfig(content string) error {
+	current, err := ioutil.ReadFile(a.ConfigPath)
+	if os.IsNotExist(err) || (err == nil && string(current) == content) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// The timestamp is the id, and sorts lexically in time order.
+	id := time.Now().UTC().Format(CONFIG_BACKUP_TIME_FORMAT)
+	if err := util.AtomicWrite(a.backupPrefix()+id, string(current)); err != nil {
+		return err
+	}
+
+	if backups, err := a.ListConfigBackups(); err != nil {
+		return err
+	} else {
+		for i := CONFIG_BACKUP_COUNT; i < len(backups); i++ {
+			if err := os.Remove(backups[i].path); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns the saved versions of config.json, newest first.
+func (a *Api) ListConfigBackups() ([]ConfigBackup, error) {
+	paths, err := filepath.Glob(a.backupPrefix() + "*")
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []ConfigBackup
+	for _, path := range paths {
+		id := strings.TrimPrefix(path, a.backupPrefix())
+		if t, err := time.Parse(CONFIG_BACKUP_TIME_FORMAT, id); err == nil {
+			ret = append(ret, ConfigBackup{Id: id, Time: t, path: path})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Id > ret[j].Id })
+
+	return ret, nil
+}
+
+// Replaces config.json with the backup with the specified id. The config
+// being replaced is itself backed up, and any interrupted provision is
+// discarded as it applied to the replaced config.
+func (a *Api) RestoreConfig(id string) error {
+	return a.withLock(func() error { return a.restoreConfig(id) })
+}
+
+func (a *Api) restoreConfig(id string) error {
+	var backup *ConfigBackup
+	if backups, err := a.ListConfigBackups(); err != nil {
+		return err
+	} else {
+		for i := range backups {
+			if backups[i].Id == id {
+				backup = &backups[i]
+			}
+		}
+	}
+	if backup == nil {
+		return newError(ErrorInvalidOptions, "No config backup %s.", id)
+	}
+
+	content, err := ioutil.ReadFile(backup.path)
+	if err != nil {
+		return err
+	}
+	if conf, err := parseConfig(string(content), ""); err != nil {
+		return fmt.Errorf("Cannot parse config backup %s: %s", id, err)
+	} else if err := conf.Validate(); err != nil {
+		return err
+	}
+
+	if err := a.backupConfig(string(content)); err != nil {
+		return fmt.Errorf("Cannot back up config: %s", err)
+	} else if err := util.AtomicWrite(a.ConfigPath, string(content)); err != nil {
+		return err
+	}
+
+	j, err := a.readJournal()
+	if err != nil {
+		return err
+	}
+	return j.remove()
+}
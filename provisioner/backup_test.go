@@ -0,0 +1,49 @@
+package provisioner
+
+import (
+	"testing"
+)
+
+func TestConfigBackups(t *testing.T) {
+	api, cleanup := newTestApi(t)
+	defer cleanup()
+
+	for i := 0; i < CONFIG_BACKUP_COUNT+2; i++ {
+		conf, err := api.readConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conf.ListenPort = string('1' + rune(i))
+		if err := api.writeConfig(conf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backups, err := api.ListConfigBackups()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(backups) != CONFIG_BACKUP_COUNT {
+		t.Fatalf("Expected %d backups, got %d", CONFIG_BACKUP_COUNT, len(backups))
+	}
+
+	// The oldest backups, including the original, have been pruned so
+	// restore the newest.
+	if err := api.RestoreConfig(backups[0].Id); err != nil {
+		t.Fatalf("Restore failed: %s", err)
+	} else if conf, err := api.readConfig(); err != nil {
+		t.Fatal(err)
+	} else if expected := string('1' + rune(CONFIG_BACKUP_COUNT)); conf.ListenPort != expected {
+		t.Errorf("Expected listenPort %s after restore, got %s", expected, conf.ListenPort)
+	}
+
+	if err := api.RestoreConfig("nonsense"); errorCode(err) != ErrorInvalidOptions {
+		t.Errorf("Expected invalid options restoring unknown backup, got %v", err)
+	}
+
+	// Restoring backed up the config it replaced.
+	if latest, err := api.ListConfigBackups(); err != nil {
+		t.Fatal(err)
+	} else if latest[0].Id == backups[0].Id {
+		t.Error("Config replaced by restore not backed up")
+	}
+}
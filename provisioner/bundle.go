@@ -0,0 +1,66 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// A provisioning bundle is a pre-generated JSON document holding everything
+// needed to provision a device, so it can be done without a keyboard or
+// credentials on the device itself.
+type Bundle struct {
+	ApplicationId    string `json:"applicationId"`
+	ApiKey           string `json:"apiKey"`
+	UserId           string `json:"userId"`
+	UserName         string `json:"username,omitempty"`
+	DeviceName       string `json:"deviceName,omitempty"`
+	ApiEndpoint      string `json:"apiEndpoint,omitempty"`
+	VpnEndpoint      string `json:"vpnEndpoint,omitempty"`
+	RegistryEndpoint string `json:"registryEndpoint,omitempty"`
+	DeltaEndpoint    string `json:"deltaEndpoint,omitempty"`
+}
+
+func ParseBundle(str string) (*Bundle, error) {
+	ret := new(Bundle)
+
+	if err := json.Unmarshal([]byte(str), ret); err != nil {
+		return nil, newError(ErrorInvalidOptions, "Invalid bundle: %s", err)
+	}
+
+	return ret, ret.Validate()
+}
+
+func (b *Bundle) ProvisionOpts() *ProvisionOpts {
+	return &ProvisionOpts{
+		UserId:           b.UserId,
+		UserName:         b.UserName,
+		ApplicationId:    b.ApplicationId,
+		ApiKey:           b.ApiKey,
+		DeviceName:       b.DeviceName,
+		ApiEndpoint:      b.ApiEndpoint,
+		VpnEndpoint:      b.VpnEndpoint,
+		RegistryEndpoint: b.RegistryEndpoint,
+		DeltaEndpoint:    b.DeltaEndpoint,
+	}
+}
+
+// Bundles are held to the same rules as options passed directly.
+func (b *Bundle) Validate() error {
+	return b.ProvisionOpts().Validate()
+}
+
+func (b *Bundle) String() (string, error) {
+	if bytes, err := json.MarshalIndent(b, "", "  "); err != nil {
+		return "", fmt.Errorf("Cannot encode bundle: %s", err)
+	} else {
+		return string(bytes) + "\n", nil
+	}
+}
+
+func (a *Api) ProvisionBundle(b *Bundle) error {
+	if err := b.Validate(); err != nil {
+		return err
+	}
+
+	return a.Provision(b.ProvisionOpts())
+}
@@ -0,0 +1,30 @@
+package provisioner
+
+import "testing"
+
+func TestParseBundle(t *testing.T) {
+	valid := `{"applicationId": "123", "apiKey": "abcDEF123", "userId": "275",
+		"deviceName": "bench-1", "apiEndpoint": "https://api.example.com",
+		"vpnEndpoint": "vpn.example.com"}`
+	if bundle, err := ParseBundle(valid); err != nil {
+		t.Errorf("Valid bundle rejected: %s", err)
+	} else if opts := bundle.ProvisionOpts(); opts.DeviceName != "bench-1" ||
+		opts.ApiEndpoint != "https://api.example.com" {
+		t.Errorf("Bundle not converted to options: %+v", opts)
+	}
+
+	for _, invalid := range []string{
+		`{"applicationId": "123", "apiKey": "abcDEF123"}`,
+		`{"applicationId": "abc", "apiKey": "abcDEF123", "userId": "275"}`,
+		`{"applicationId": "123", "apiKey": "abcDEF123", "userId": "275",
+			"apiEndpoint": "api.example.com"}`,
+		`{"applicationId": "123", "apiKey": "abcDEF123", "userId": "275",
+			"vpnEndpoint": "https://vpn.example.com"}`,
+	} {
+		if _, err := ParseBundle(invalid); err == nil {
+			t.Errorf("Invalid bundle accepted: %s", invalid)
+		} else if errorCode(err) != ErrorInvalidOptions {
+			t.Errorf("Unexpected error code for %s: %s", invalid, errorCode(err))
+		}
+	}
+}
@@ -1,22 +1,31 @@
 package provisioner
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"reflect"
+	"strings"
 
 	"github.com/resin-os/resin-provisioner/resin"
 	"github.com/resin-os/resin-provisioner/util"
 )
 
+// Shown in place of the values of sensitive fields.
+const REDACTED = "<redacted>"
+
+// Fields holding secrets are tagged sensitive:"true" so that they are redacted
+// when the config is shown.
 type Config struct {
 	Uuid                  string `json:"uuid"`
 	ApplicationId         string `json:"applicationId"`
-	ApiKey                string `json:"apiKey"`
+	ApiKey                string `json:"apiKey" sensitive:"true"`
 	UserId                string `json:"userId"`
 	UserName              string `json:"username"`
-	DeviceId              int64  `json:"deviceId",omitempty`
+	DeviceId              int64  `json:"deviceId,omitempty"`
 	DeviceType            string `json:"deviceType"`
 	RegisteredAt          int64  `json:"registered_at,omitempty"`
 	AppUpdatePollInterval string `json:"appUpdatePollInterval"`
@@ -26,12 +35,12 @@ type Config struct {
 	VpnEndpoint           string `json:"vpnEndpoint"`
 	RegistryEndpoint      string `json:"registryEndpoint"`
 	DeltaEndpoint         string `json:"deltaEndpoint"`
-	PubnubSubscribeKey    string `json:"pubnubSubscribeKey"`
-	PubnubPublishKey      string `json:"pubnubPublishKey"`
-	MixpanelToken         string `json:"mixpanelToken"`
+	PubnubSubscribeKey    string `json:"pubnubSubscribeKey" sensitive:"true"`
+	PubnubPublishKey      string `json:"pubnubPublishKey" sensitive:"true"`
+	MixpanelToken         string `json:"mixpanelToken" sensitive:"true"`
 
-	// See json.go/parseConfig() for more details on what this is for.
-	InitialRaw map[string]interface{} `json:"-"`
+	// The JSON the config was parsed from, see json.go/stringifyConfig().
+	InitialJson []byte `json:"-"`
 }
 
 func (a *Api) readConfig() (*Config, error) {
@@ -45,9 +54,15 @@ func (a *Api) readConfig() (*Config, error) {
 	}
 }
 
+// Writes the config, refusing to if it is invalid as the supervisor may be
+// unable to start with it. The previous version is kept as a backup.
 func (a *Api) writeConfig(conf *Config) error {
-	if str, err := stringifyConfig(conf); err != nil {
+	if err := conf.Validate(); err != nil {
+		return err
+	} else if str, err := stringifyConfig(conf); err != nil {
 		return err
+	} else if err := a.backupConfig(str); err != nil {
+		return fmt.Errorf("Cannot back up config: %s", err)
 	} else {
 		return util.AtomicWrite(a.ConfigPath, str)
 	}
@@ -65,6 +80,131 @@ func (c *Config) ProvisionedState() ProvisionedState {
 	return Provisioned
 }
 
+// Returns a copy of the config with the values of sensitive fields replaced by
+// REDACTED.
+func (c *Config) Redacted() *Config {
+	ret := *c
+
+	value := reflect.ValueOf(&ret).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		if isSensitive(value.Type().Field(i)) && field.Kind() == reflect.String &&
+			field.String() != "" {
+			field.SetString(REDACTED)
+		}
+	}
+
+	return &ret
+}
+
+// A problem with a config.json field.
+type ConfigError struct {
+	Field   string
+	Message string
+}
+
+func (e ConfigError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// Every problem found validating a config.
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	var msgs []string
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+
+	return "Invalid config: " + strings.Join(msgs, " ")
+}
+
+// Checks the config is fit for the supervisor to use, returning ConfigErrors
+// listing every problem found. Which fields are required depends on the
+// provisioned state.
+func (c *Config) Validate() error {
+	var errs ConfigErrors
+	check := func(ok bool, field, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, ConfigError{field, fmt.Sprintf(format, args...)})
+		}
+	}
+
+	check(isValidUrl(c.ApiEndpoint), "apiEndpoint", "Invalid URL %q.", c.ApiEndpoint)
+	check(isValidHost(c.VpnEndpoint), "vpnEndpoint", "Invalid host %q.", c.VpnEndpoint)
+	check(isValidHost(c.RegistryEndpoint), "registryEndpoint", "Invalid host %q.",
+		c.RegistryEndpoint)
+	check(isValidUrl(c.DeltaEndpoint), "deltaEndpoint", "Invalid URL %q.", c.DeltaEndpoint)
+	check(isValidPort(c.ListenPort), "listenPort", "Invalid port %q.", c.ListenPort)
+	check(isValidPort(c.VpnPort), "vpnPort", "Invalid port %q.", c.VpnPort)
+	check(isPositiveInteger(c.AppUpdatePollInterval), "appUpdatePollInterval",
+		"Invalid interval %q.", c.AppUpdatePollInterval)
+	check(c.Uuid == "" || uuidRegexp.MatchString(c.Uuid), "uuid", "Invalid uuid %q.", c.Uuid)
+	check(c.DeviceId >= 0, "deviceId", "Invalid device id %d.", c.DeviceId)
+
+	if state := c.ProvisionedState(); state == Unprovisioned {
+		// Left over from a provision which wasn't cleared properly.
+		check(c.RegisteredAt == 0, "registered_at", "Set on an unprovisioned device.")
+	} else {
+		check(c.Uuid != "", "uuid", "Required when %s.", state)
+		check(isInteger(c.ApplicationId), "applicationId", "Invalid application id %q.",
+			c.ApplicationId)
+		check(isInteger(c.UserId), "userId", "Invalid user id %q.", c.UserId)
+		check(isValidApiKey(c.ApiKey), "apiKey", "Invalid API key.")
+		check(c.DeviceType != "", "deviceType", "Required when %s.", state)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Reads the config file and checks it, returning ConfigErrors listing every
+// problem found if it is invalid. Unlike readConfig this fails if the file
+// doesn't exist, and the file is checked as is, without filling in defaults
+// or detecting the device type, so missing fields are reported.
+func (a *Api) ValidateConfig() error {
+	var fields map[string]json.RawMessage
+	conf := new(Config)
+
+	if bytes, err := ioutil.ReadFile(a.ConfigPath); err != nil {
+		return err
+	} else if err := json.Unmarshal(bytes, &fields); err != nil {
+		return fmt.Errorf("Cannot parse config: %s", err)
+	} else if err := json.Unmarshal(bytes, conf); err != nil {
+		return fmt.Errorf("Cannot parse config: %s", err)
+	}
+
+	errs, ok := conf.Validate().(ConfigErrors)
+	if !ok {
+		return nil
+	}
+	for i := range errs {
+		if _, ok := fields[errs[i].Field]; !ok {
+			errs[i].Message = "Missing."
+		}
+	}
+
+	return errs
+}
+
+// Clears all fields set by provisioning, returning the config to the
+// unprovisioned state. The uuid is kept unless rotateUuid is set, in which
+// case a new one will be generated on the next provision.
+func (c *Config) ClearProvisioning(rotateUuid bool) {
+	c.ApplicationId = ""
+	c.ApiKey = ""
+	c.UserId = ""
+	c.UserName = ""
+	c.DeviceId = 0
+	c.RegisteredAt = 0
+
+	if rotateUuid {
+		c.Uuid = ""
+	}
+}
+
 // If DeviceType not specified, attempt to determine it and assign.
 func (c *Config) DetectDeviceType() error {
 	if c.DeviceType != "" {
@@ -80,16 +220,17 @@ func (c *Config) DetectDeviceType() error {
 	return nil
 }
 
-// Get /config from the Resin API specified at c.ApiEndpoint
-func (c Config) getConfigFromApi() (map[string]interface{}, error) {
-	return resin.GetConfig(c.ApiEndpoint)
+// Get and populate mixpanel and pubnub keys from the Resin API specified at
+// c.ApiEndpoint
+func (c *Config) GetKeysFromApi() error {
+	return c.GetKeysFromClient(context.Background(), resin.NewClient(c.ApiEndpoint))
 }
 
-// Get and populate mixpanel and pubnub keys from the Resin API
-func (c *Config) GetKeysFromApi() error {
+// Get and populate mixpanel and pubnub keys using the specified client
+func (c *Config) GetKeysFromClient(ctx context.Context, client *resin.Client) error {
 	// GET /config from api
-	if conf, err := c.getConfigFromApi(); err != nil {
-		return fmt.Errorf("Error getting config from Resin API: %s", err)
+	if conf, err := client.GetConfig(ctx); err != nil {
+		return fmt.Errorf("Error getting config from Resin API: %w", err)
 	} else {
 		i := errors.New("Invalid config received from the Resin API")
 		if t, ok := conf["mixpanelToken"].(string); !ok {
@@ -0,0 +1,121 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+)
+
+func TestConfigValidate(t *testing.T) {
+	conf, err := parseConfig(minimalJson, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Errorf("Minimal config invalid: %s", err)
+	}
+
+	// Provisioning without a uuid, with a bad port and endpoint.
+	conf.ApplicationId = "123"
+	conf.ApiKey = "abc"
+	conf.UserId = "456"
+	conf.VpnPort = "https"
+	conf.ApiEndpoint = ""
+
+	errs, ok := conf.Validate().(ConfigErrors)
+	if !ok {
+		t.Fatalf("Expected ConfigErrors, got %v", conf.Validate())
+	}
+	fields := make(map[string]bool)
+	for _, err := range errs {
+		fields[err.Field] = true
+	}
+	for _, field := range []string{"uuid", "vpnPort", "apiEndpoint"} {
+		if !fields[field] {
+			t.Errorf("Expected an error for %s, got %s", field, errs)
+		}
+	}
+	if len(errs) != 3 {
+		t.Errorf("Expected 3 errors, got %s", errs)
+	}
+}
+
+func TestWriteConfigRefusesInvalid(t *testing.T) {
+	api, cleanup := newTestApi(t)
+	defer cleanup()
+
+	conf, err := api.readConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.AppUpdatePollInterval = "often"
+	if err := api.writeConfig(conf); err == nil {
+		t.Error("Invalid config written")
+	} else if bytes, err := ioutil.ReadFile(api.ConfigPath); err != nil || string(bytes) != minimalJson {
+		t.Errorf("Existing config clobbered: %v", err)
+	}
+}
+
+// Returns the fields ValidateConfig reports for the config file contents,
+// along with their messages.
+func validateConfigFile(t *testing.T, api *Api, contents string) map[string]string {
+	if err := ioutil.WriteFile(api.ConfigPath, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ret := make(map[string]string)
+	if err := api.ValidateConfig(); err == nil {
+		return ret
+	} else if errs, ok := err.(ConfigErrors); !ok {
+		t.Fatalf("Expected ConfigErrors, got %v", err)
+	} else {
+		for _, err := range errs {
+			ret[err.Field] = err.Message
+		}
+	}
+
+	return ret
+}
+
+func TestValidateConfigFile(t *testing.T) {
+	api, cleanup := newTestApi(t)
+	defer cleanup()
+
+	conf, err := api.readConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	complete, err := stringifyConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := validateConfigFile(t, api, complete); len(errs) != 0 {
+		t.Errorf("Complete config invalid: %v", errs)
+	}
+
+	// Defaults aren't filled in.
+	errs := validateConfigFile(t, api, "{}")
+	for _, field := range []string{"apiEndpoint", "vpnEndpoint", "registryEndpoint",
+		"deltaEndpoint", "listenPort", "vpnPort", "appUpdatePollInterval"} {
+		if errs[field] != "Missing." {
+			t.Errorf("Expected %s missing from {}, got %v", field, errs)
+		}
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(complete), &fields); err != nil {
+		t.Fatal(err)
+	}
+	delete(fields, "apiEndpoint")
+	delete(fields, "deltaEndpoint")
+	fields["vpnEndpoint"] = ""
+	noEndpoints, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs = validateConfigFile(t, api, string(noEndpoints))
+	if len(errs) != 3 || errs["apiEndpoint"] != "Missing." || errs["deltaEndpoint"] != "Missing." ||
+		errs["vpnEndpoint"] == "" || errs["vpnEndpoint"] == "Missing." {
+		t.Errorf("Unexpected errors without endpoints: %v", errs)
+	}
+}
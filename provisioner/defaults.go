@@ -1,5 +1,7 @@
 package provisioner
 
+import "time"
+
 const (
 	SERVICES_ROOT_PATH      = "/lib/systemd/system/"
 	MOUNT_OVERLAY_PATH      = SERVICES_ROOT_PATH + "etc-systemd-system-resin.target.wants.mount"
@@ -9,10 +11,27 @@ const (
 	SUPERVISOR_CONF_PATH    = "/etc/resin-supervisor/supervisor.conf"
 	RESIN_SERVICES_PATH     = "/etc/resin-connectable.conf"
 
+	JOURNAL_SUFFIX = ".journal"
+	LOCK_SUFFIX    = ".lock"
+
+	// Backups of config.json are kept alongside it, named by the time they
+	// were taken.
+	CONFIG_BACKUP_SUFFIX      = ".backup."
+	CONFIG_BACKUP_TIME_FORMAT = "20060102-150405.000000000"
+	CONFIG_BACKUP_COUNT       = 5
+
+	BUNDLE_FILE_NAME     = "resin-provision.json"
+	BUNDLE_POLL_INTERVAL = 5 * time.Second
+
 	DEFAULT_RESIN_DOMAIN        = "resin.io"
 	INIT_UPDATER_SUPERVISOR_TAG = "production"
 
 	UUID_BYTE_LENGTH = 31
+
+	// Finished background provisions are remembered until this many newer
+	// ones have been started.
+	JOB_HISTORY_COUNT  = 10
+	JOB_ID_BYTE_LENGTH = 8
 )
 
 var DefaultConfig = Config{
@@ -0,0 +1,70 @@
+package provisioner
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/resin-os/resin-provisioner/resin"
+)
+
+// Classifies errors returned by the Api so front-ends can report them
+// appropriately, e.g. as an HTTP status code.
+type ErrorCode string
+
+const (
+	ErrorInvalidOptions ErrorCode = "invalid_options"
+	ErrorUnsupported    ErrorCode = "unsupported"
+	ErrorConflict       ErrorCode = "conflict"
+	ErrorNotFound       ErrorCode = "not_found"
+	ErrorUnauthorized   ErrorCode = "unauthorized"
+	ErrorForbidden      ErrorCode = "forbidden"
+	ErrorResinApi       ErrorCode = "resin_api"
+	ErrorSupervisor     ErrorCode = "supervisor"
+	ErrorUnavailable    ErrorCode = "unavailable"
+	ErrorInternal       ErrorCode = "internal"
+)
+
+type Error struct {
+	Code ErrorCode
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func newError(code ErrorCode, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Err: fmt.Errorf(format, args...)}
+}
+
+// Marks an error as having come from the resin API. Whatever the API said, it
+// is reported as ErrorResinApi so it can't be mistaken for our own response,
+// e.g. the API rejecting our credentials for the caller being unauthorized.
+func resinApiError(err error) error {
+	if err == nil {
+		return nil
+	} else if errors.Is(err, resin.ErrUnauthorized) {
+		err = fmt.Errorf("Resin API rejected our credentials: %w", err)
+	} else if errors.Is(err, resin.ErrConflict) {
+		err = fmt.Errorf("Resin API reported a conflict: %w", err)
+	}
+
+	return &Error{Code: ErrorResinApi, Err: err}
+}
+
+// Returns the code for any error, unclassified errors being internal.
+func errorCode(err error) ErrorCode {
+	var apiErr *Error
+	var supervisorErr *SupervisorError
+	if errors.As(err, &apiErr) {
+		return apiErr.Code
+	} else if errors.As(err, &supervisorErr) {
+		return ErrorSupervisor
+	}
+
+	return ErrorInternal
+}
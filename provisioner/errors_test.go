@@ -0,0 +1,38 @@
+package provisioner
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/resin-os/resin-provisioner/resin"
+)
+
+func TestResinApiError(t *testing.T) {
+	for _, kind := range []error{resin.ErrUnauthorized, resin.ErrConflict, resin.ErrNotFound} {
+		err := resinApiError(&resin.ApiError{Method: "POST", Path: "/v1/device", Kind: kind})
+		if code := errorCode(err); code != ErrorResinApi {
+			t.Errorf("%s: expected %s, got %s", kind, ErrorResinApi, code)
+		} else if !errors.Is(err, kind) {
+			t.Errorf("%s: upstream classification lost", kind)
+		}
+	}
+
+	err := resinApiError(&resin.ApiError{Method: "POST", Path: "/v1/device", Kind: resin.ErrUnauthorized})
+	if !strings.Contains(err.Error(), "credentials") {
+		t.Errorf("Classification missing from %q", err)
+	}
+}
+
+func TestErrorCodeWrapped(t *testing.T) {
+	err := fmt.Errorf("Cannot move: %w", newError(ErrorConflict, "Device is busy."))
+	if code := errorCode(err); code != ErrorConflict {
+		t.Errorf("Expected %s, got %s", ErrorConflict, code)
+	}
+
+	err = fmt.Errorf("Cannot resume: %w", &SupervisorError{Step: StepEnableServices, Err: errors.New("x")})
+	if code := errorCode(err); code != ErrorSupervisor {
+		t.Errorf("Expected %s, got %s", ErrorSupervisor, code)
+	}
+}
@@ -0,0 +1,192 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+type EventType string
+
+const (
+	// A provisioning step started, finished or failed.
+	EventStep EventType = "step"
+	// The supervisor services were started, or failed to start.
+	EventSupervisor EventType = "supervisor"
+	// The device's provisioned state changed.
+	EventState EventType = "state"
+)
+
+const (
+	EventStarted = "started"
+	EventDone    = "done"
+	EventFailed  = "failed"
+)
+
+// Progress of provisioning, as streamed by GET /events.
+type Event struct {
+	Time   time.Time      `json:"time"`
+	Type   EventType      `json:"type"`
+	Step   ProvisionStep  `json:"step,omitempty"`
+	Status string         `json:"status,omitempty"`
+	State  string         `json:"state,omitempty"`
+	Error  *responseError `json:"error,omitempty"`
+	// The id of the job the event came from, if any.
+	Job string `json:"job,omitempty"`
+}
+
+// Events buffered per subscriber, beyond which a slow reader misses events.
+const EVENT_BUFFER = 64
+
+// Messages for errors reported by events and jobs. Unlike responses these can
+// be read by anyone able to connect, so the details, which may include
+// upstream responses or credentials, are only logged.
+var eventErrorMessages = map[ErrorCode]string{
+	ErrorInvalidOptions: "Invalid provisioning options.",
+	ErrorUnsupported:    "Unsupported operation.",
+	ErrorConflict:       "Conflicts with the device's state.",
+	ErrorNotFound:       "Not found.",
+	ErrorUnauthorized:   "Unauthorized.",
+	ErrorForbidden:      "Forbidden.",
+	ErrorResinApi:       "Resin API request failed.",
+	ErrorSupervisor:     "Supervisor failed to start.",
+	ErrorUnavailable:    "Shutting down.",
+	ErrorInternal:       "Internal error.",
+}
+
+func eventError(err error) *responseError {
+	code := errorCode(err)
+	return &responseError{Code: code, Message: eventErrorMessages[code]}
+}
+
+// Returns a channel receiving events from now on, and a function to stop
+// receiving them.
+func (a *Api) subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, EVENT_BUFFER)
+	state, err := a.State()
+
+	a.eventsMutex.Lock()
+	if a.subscribers == nil {
+		a.subscribers = make(map[chan Event]bool)
+	}
+	if len(a.subscribers) == 0 && err == nil {
+		// State isn't tracked without subscribers, so changes are
+		// relative to now.
+		a.lastState = state
+	}
+	a.subscribers[ch] = true
+	a.eventsMutex.Unlock()
+
+	return ch, func() {
+		a.eventsMutex.Lock()
+		delete(a.subscribers, ch)
+		a.eventsMutex.Unlock()
+	}
+}
+
+func (a *Api) emit(event Event) {
+	event.Time = time.Now()
+
+	a.eventsMutex.Lock()
+	defer a.eventsMutex.Unlock()
+
+	event.Job = a.eventJob
+	for ch := range a.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// Don't hold up provisioning for a stalled client.
+		}
+	}
+}
+
+// Tags subsequent events with the job id, or stops tagging them if empty.
+func (a *Api) setEventJob(id string) {
+	a.eventsMutex.Lock()
+	a.eventJob = id
+	a.eventsMutex.Unlock()
+}
+
+// Emits a state event if the state has changed since the last one.
+func (a *Api) emitState() {
+	a.eventsMutex.Lock()
+	subscribed := len(a.subscribers) > 0
+	a.eventsMutex.Unlock()
+	if !subscribed {
+		return
+	}
+
+	state, err := a.State()
+	if err != nil {
+		return
+	}
+
+	a.eventsMutex.Lock()
+	changed := state != a.lastState
+	a.lastState = state
+	a.eventsMutex.Unlock()
+
+	if changed {
+		a.emit(Event{Type: EventState, State: state.String()})
+	}
+}
+
+// Wraps run so that each step emits events as it starts and finishes, along
+// with any resulting change of state.
+func (a *Api) trackSteps(run func(ProvisionStep) error) func(ProvisionStep) error {
+	return func(step ProvisionStep) error {
+		a.emit(Event{Type: EventStep, Step: step, Status: EventStarted})
+
+		if err := run(step); err != nil {
+			log.Printf("ERROR: Step %s failed: %s\n", step, err)
+			a.emit(Event{Type: EventStep, Step: step, Status: EventFailed,
+				Error: eventError(err)})
+			return err
+		}
+
+		a.emit(Event{Type: EventStep, Step: step, Status: EventDone})
+		a.emitState()
+		return nil
+	}
+}
+
+// Streams events as newline delimited JSON until the client goes away or we
+// shut down, starting with the current state.
+func (a *Api) eventsHandler(writer http.ResponseWriter, req *http.Request) {
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		a.reportError(writer, req, newError(ErrorUnsupported, "Streaming unsupported."), "")
+		return
+	}
+
+	events, unsubscribe := a.subscribe()
+	defer unsubscribe()
+
+	state, err := a.State()
+	if err != nil {
+		a.reportError(writer, req, err, "Can't read provisioned status.")
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/x-ndjson")
+	writer.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(writer)
+	event := Event{Time: time.Now(), Type: EventState, State: state.String()}
+	for {
+		if err := encoder.Encode(event); err != nil {
+			log.Printf("ERROR: Can't write event: %s\n", err)
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case event = <-events:
+		case <-req.Context().Done():
+			return
+		case <-a.stopping:
+			return
+		}
+	}
+}
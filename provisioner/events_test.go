@@ -0,0 +1,89 @@
+package provisioner
+
+import (
+	"bufio"
+	"encoding/json"
+	"testing"
+)
+
+func TestEventsStreamProvisionProgress(t *testing.T) {
+	defer withResinServices(t, "resin-supervisor.service\n")()
+	server, opts := newTestServer(t)
+	defer server.Close()
+	api, cleanup := newTestApi(t)
+	defer cleanup()
+	client := serveTestSocket(t, api)
+	defer api.Cleanup()
+
+	resp, err := client.Get("http://provisioner/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	read := func() Event {
+		var event Event
+		if !scanner.Scan() {
+			t.Fatalf("Event stream ended: %v", scanner.Err())
+		} else if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("Invalid event %q: %s", scanner.Text(), err)
+		}
+		return event
+	}
+
+	// The current state is sent first, after which we're subscribed.
+	if event := read(); event.Type != EventState || event.State != Unprovisioned.String() {
+		t.Fatalf("Unexpected initial event %+v", event)
+	}
+
+	errs := make(chan error, 1)
+	go func() { errs <- api.Provision(opts) }()
+
+	done := make(map[ProvisionStep]bool)
+	supervisor := ""
+	for {
+		event := read()
+		if event.Type == EventStep && event.Status == EventDone {
+			done[event.Step] = true
+		} else if event.Type == EventSupervisor {
+			supervisor = event.Status
+		} else if event.Type == EventState && event.State == Provisioned.String() {
+			break
+		}
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatalf("Provision failed: %s", err)
+	}
+	for _, step := range append(configSteps, serviceSteps...) {
+		if !done[step] {
+			t.Errorf("No event for step %s", step)
+		}
+	}
+	if supervisor != EventStarted {
+		t.Errorf("Expected supervisor started event, got %q", supervisor)
+	}
+}
+
+func TestEventsOnlyOnStateChange(t *testing.T) {
+	api, cleanup := newTestApi(t)
+	defer cleanup()
+
+	events, unsubscribe := api.subscribe()
+	defer unsubscribe()
+
+	// Neither a rejected provision nor a failed restore changes anything.
+	if err := api.Provision(&ProvisionOpts{UserId: "abc"}); errorCode(err) != ErrorInvalidOptions {
+		t.Errorf("Expected invalid options, got %v", err)
+	}
+	if err := api.RestoreConfig("unknown"); errorCode(err) != ErrorInvalidOptions {
+		t.Errorf("Expected invalid options, got %v", err)
+	}
+
+	select {
+	case event := <-events:
+		t.Errorf("Unexpected event %+v", event)
+	default:
+	}
+}
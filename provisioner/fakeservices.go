@@ -0,0 +1,103 @@
+package provisioner
+
+import (
+	"fmt"
+	pathLib "path"
+)
+
+// An in-memory ServiceManager which records the calls made to it, for use in
+// tests and on machines without systemd.
+type FakeServiceManager struct {
+	// Calls made, in order, e.g. "start resin-supervisor.service".
+	Calls []string
+	// Errors to return for specific calls, keyed as in Calls.
+	Errors map[string]error
+
+	units map[string]*UnitStatus
+}
+
+func NewFakeServiceManager() *FakeServiceManager {
+	return &FakeServiceManager{
+		Errors: make(map[string]error),
+		units:  make(map[string]*UnitStatus),
+	}
+}
+
+func (f *FakeServiceManager) record(action, path string) error {
+	call := fmt.Sprintf("%s %s", action, pathLib.Base(path))
+	f.Calls = append(f.Calls, call)
+
+	return f.Errors[call]
+}
+
+func (f *FakeServiceManager) unit(path string) *UnitStatus {
+	name := pathLib.Base(path)
+	if f.units[name] == nil {
+		f.units[name] = &UnitStatus{Name: name, LoadState: "loaded",
+			ActiveState: "inactive", SubState: "dead"}
+	}
+
+	return f.units[name]
+}
+
+func (f *FakeServiceManager) EnableUnits(paths []string) error {
+	for _, path := range paths {
+		if err := f.record("enable", path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *FakeServiceManager) DisableUnits(paths []string) error {
+	for _, path := range paths {
+		if err := f.record("disable", path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *FakeServiceManager) StartUnit(path string) error {
+	if err := f.record("start", path); err != nil {
+		return err
+	}
+
+	unit := f.unit(path)
+	unit.ActiveState, unit.SubState = "active", "running"
+	return nil
+}
+
+func (f *FakeServiceManager) StopUnit(path string) error {
+	if err := f.record("stop", path); err != nil {
+		return err
+	}
+
+	unit := f.unit(path)
+	unit.ActiveState, unit.SubState = "inactive", "dead"
+	return nil
+}
+
+func (f *FakeServiceManager) RestartUnit(path string) error {
+	if err := f.record("restart", path); err != nil {
+		return err
+	}
+
+	unit := f.unit(path)
+	unit.ActiveState, unit.SubState = "active", "running"
+	return nil
+}
+
+func (f *FakeServiceManager) UnitStatus(path string) (*UnitStatus, error) {
+	if status, ok := f.units[pathLib.Base(path)]; ok {
+		ret := *status
+		return &ret, nil
+	}
+
+	return nil, nil
+}
+
+func (f *FakeServiceManager) Close() {
+}
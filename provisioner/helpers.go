@@ -2,19 +2,25 @@ package provisioner
 
 import (
 	"crypto/rand"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"regexp"
 	"strconv"
+	"strings"
 
 	"github.com/resin-os/resin-provisioner/util"
 )
 
 var apiKeyRegexp = regexp.MustCompile("[a-zA-Z0-9]+")
+var hostRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9.-]*[a-zA-Z0-9])?$`)
+var uuidRegexp = regexp.MustCompile(`^[a-fA-F0-9]+$`)
 
 func checkSocket(path string) error {
 	// The socket file not existing means we can create it.
@@ -37,21 +43,70 @@ func readerToString(r io.Reader) (ret string, err error) {
 	return
 }
 
-func reportError(status int, writer http.ResponseWriter, req *http.Request,
+// HTTP status codes for each class of error.
+var errorStatuses = map[ErrorCode]int{
+	ErrorInvalidOptions: http.StatusBadRequest,
+	ErrorUnsupported:    http.StatusMethodNotAllowed,
+	ErrorConflict:       http.StatusConflict,
+	ErrorNotFound:       http.StatusNotFound,
+	ErrorUnauthorized:   http.StatusUnauthorized,
+	ErrorForbidden:      http.StatusForbidden,
+	ErrorResinApi:       http.StatusBadGateway,
+	ErrorSupervisor:     http.StatusInternalServerError,
+	ErrorUnavailable:    http.StatusServiceUnavailable,
+	ErrorInternal:       http.StatusInternalServerError,
+}
+
+// Writes resp as JSON, filling in the current state if not already set.
+func (a *Api) writeResponse(status int, writer http.ResponseWriter, resp *response) {
+	if resp.State == "" {
+		if state, err := a.State(); err == nil {
+			resp.State = state.String()
+		} else {
+			resp.State = Unknown.String()
+		}
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	if err := json.NewEncoder(writer).Encode(resp); err != nil {
+		log.Printf("ERROR: Can't encode response: %s\n", err)
+	}
+}
+
+func (a *Api) reportError(writer http.ResponseWriter, req *http.Request,
 	err error, userErr string) {
+	code := errorCode(err)
 	log.Printf("ERROR: %s %s: %s (%s)\n", req.Method, req.URL.Path, err,
 		userErr)
 
-	writer.WriteHeader(status)
-	fmt.Fprintf(writer, "ERROR: %s", userErr)
+	// Internal errors aren't much use to the user, others are meant for
+	// them.
+	message := userErr
+	if code != ErrorInternal {
+		message = strings.TrimSpace(fmt.Sprintf("%s %s", userErr, err))
+	}
+
+	resp := &response{Error: &responseError{Code: code, Message: message}}
+	if code == ErrorSupervisor {
+		resp.Supervisor = "failed"
+	}
+
+	a.writeResponse(errorStatuses[code], writer, resp)
 }
 
-func readPostBodyReportErr(writer http.ResponseWriter, req *http.Request) string {
+func (a *Api) readPostBodyReportErr(writer http.ResponseWriter, req *http.Request) string {
 	// req.Body doesn't need to be closed by us.
 	if str, err := readerToString(req.Body); err != nil {
-		reportError(500, writer, req, err,
+		a.reportError(writer, req, err,
 			"Can't convert read to string")
 
+		return ""
+	} else if str == "" {
+		a.reportError(writer, req,
+			newError(ErrorInvalidOptions, "Empty request body."),
+			"No options specified.")
+
 		return ""
 	} else {
 		return str
@@ -64,17 +119,51 @@ func isInteger(str string) bool {
 	return err == nil
 }
 
+func isPositiveInteger(str string) bool {
+	n, err := strconv.Atoi(str)
+
+	return err == nil && n > 0
+}
+
+func isValidPort(str string) bool {
+	n, err := strconv.Atoi(str)
+
+	return err == nil && n > 0 && n <= 65535
+}
+
 func isValidApiKey(str string) bool {
 	return apiKeyRegexp.Match([]byte(str))
 }
 
-func supervisorDbusRunning() (bool, error) {
-	if dbus, err := NewDbus(); err != nil {
+// Checks for an absolute http(s) URL, as used for the API and delta endpoints.
+func isValidUrl(str string) bool {
+	u, err := url.Parse(str)
+
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") &&
+		isValidHost(u.Host)
+}
+
+// Checks for a bare host name, optionally with a port, as used for the vpn
+// and registry endpoints.
+func isValidHost(str string) bool {
+	host := str
+	if h, port, err := net.SplitHostPort(str); err == nil {
+		if !isValidPort(port) {
+			return false
+		}
+		host = h
+	}
+
+	return hostRegexp.MatchString(host)
+}
+
+func (a *Api) supervisorRunning() (bool, error) {
+	if services, release, err := a.services(); err != nil {
 		return false, err
 	} else {
-		defer dbus.Close()
+		defer release()
 
-		return dbus.SupervisorRunning()
+		return SupervisorRunning(services)
 	}
 }
 
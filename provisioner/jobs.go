@@ -0,0 +1,185 @@
+package provisioner
+
+import (
+	"log"
+	"time"
+)
+
+type JobStatus string
+
+const (
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+)
+
+// A provision run in the background, as started by POST /provision.
+type Job struct {
+	Id     string    `json:"id"`
+	Status JobStatus `json:"status"`
+	// The step in progress, or the last one run.
+	Step  ProvisionStep  `json:"step,omitempty"`
+	Error *responseError `json:"error,omitempty"`
+	// The registered device, once the job has finished.
+	Device   *DeviceInfo `json:"device,omitempty"`
+	Started  time.Time   `json:"started"`
+	Finished *time.Time  `json:"finished,omitempty"`
+}
+
+// Starts provisioning with opts in the background, returning the job tracking
+// it. Only one job runs at a time, so this fails with a conflict naming the
+// running job if there is one.
+func (a *Api) StartProvision(opts *ProvisionOpts) (*Job, error) {
+	// Report bad options now rather than via the job.
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	id, err := randomHexString(JOB_ID_BYTE_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+
+	a.jobsMutex.Lock()
+	defer a.jobsMutex.Unlock()
+
+	for _, job := range a.jobs {
+		if job.Status == JobRunning {
+			return nil, newError(ErrorConflict, "Provisioning in progress, see job %s.", job.Id)
+		}
+	}
+
+	// Take the lock now, so that a provision elsewhere, e.g. by the
+	// CLI, is reported as a conflict rather than as a failed job.
+	release, err := a.lock()
+	if err != nil {
+		return nil, err
+	}
+	// Shutdown waits for the job to finish.
+	if err := a.enterCritical(); err != nil {
+		release()
+		return nil, err
+	}
+
+	job := &Job{Id: id, Status: JobRunning, Started: time.Now()}
+	a.jobs = append(a.jobs, job)
+	if len(a.jobs) > JOB_HISTORY_COUNT {
+		a.jobs = a.jobs[len(a.jobs)-JOB_HISTORY_COUNT:]
+	}
+
+	ret := *job
+	go a.runJob(job, opts, release)
+
+	return &ret, nil
+}
+
+// Provisions for the job, which holds the lock until release is called.
+func (a *Api) runJob(job *Job, opts *ProvisionOpts, release func()) {
+	defer a.critical.Done()
+
+	events, unsubscribe := a.subscribe()
+	defer unsubscribe()
+
+	result := make(chan error, 1)
+	go func() {
+		a.setEventJob(job.Id)
+		err := a.provision(opts)
+		a.emitState()
+		a.setEventJob("")
+
+		// Release before reporting, so the job is never seen to have
+		// finished while still holding the lock.
+		release()
+		result <- err
+	}()
+
+	for {
+		select {
+		case event := <-events:
+			a.updateJob(job, event)
+		case err := <-result:
+			// Events are emitted synchronously, so all of the
+			// provision's are already buffered.
+			for len(events) > 0 {
+				a.updateJob(job, <-events)
+			}
+			a.finishJob(job, err)
+			return
+		}
+	}
+}
+
+func (a *Api) updateJob(job *Job, event Event) {
+	if event.Type != EventStep || event.Job != job.Id {
+		return
+	}
+
+	a.jobsMutex.Lock()
+	job.Step = event.Step
+	a.jobsMutex.Unlock()
+}
+
+func (a *Api) finishJob(job *Job, err error) {
+	// A device may be registered even if the supervisor failed to start.
+	device, _ := a.Device()
+	now := time.Now()
+
+	a.jobsMutex.Lock()
+	job.Finished = &now
+	job.Device = device
+	if err != nil {
+		log.Printf("ERROR: Job %s failed: %s\n", job.Id, err)
+		job.Status = JobFailed
+		job.Error = eventError(err)
+	} else {
+		job.Status = JobSucceeded
+	}
+	a.jobsMutex.Unlock()
+
+	// Give the client a chance to fetch the result before we exit when
+	// idle.
+	a.idleMutex.Lock()
+	a.lastActive = now
+	a.idleMutex.Unlock()
+}
+
+// Returns the job with the specified id, or nil if it's not one of the most
+// recent JOB_HISTORY_COUNT.
+func (a *Api) Job(id string) *Job {
+	a.jobsMutex.Lock()
+	defer a.jobsMutex.Unlock()
+
+	for _, job := range a.jobs {
+		if job.Id == id {
+			ret := *job
+			return &ret
+		}
+	}
+
+	return nil
+}
+
+// Returns the most recent jobs, newest first.
+func (a *Api) Jobs() []Job {
+	a.jobsMutex.Lock()
+	defer a.jobsMutex.Unlock()
+
+	ret := make([]Job, 0, len(a.jobs))
+	for i := len(a.jobs) - 1; i >= 0; i-- {
+		ret = append(ret, *a.jobs[i])
+	}
+
+	return ret
+}
+
+func (a *Api) jobRunning() bool {
+	a.jobsMutex.Lock()
+	defer a.jobsMutex.Unlock()
+
+	for _, job := range a.jobs {
+		if job.Status == JobRunning {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,115 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/resin-os/resin-provisioner/resin/resintest"
+)
+
+// Polls GET /jobs/{id} until the job has finished.
+func waitForJob(t *testing.T, api *Api, id string) *Job {
+	for i := 0; i < 500; i++ {
+		if status, resp := doRequest(t, api, "GET", "/jobs/"+id, ""); status != http.StatusOK {
+			t.Fatalf("Unexpected status %d fetching job %s", status, id)
+		} else if resp.Job.Status != JobRunning {
+			return resp.Job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("Job %s didn't finish", id)
+	return nil
+}
+
+func TestProvisionJob(t *testing.T) {
+	defer withResinServices(t, "resin-supervisor.service\n")()
+	server, opts := newTestServer(t)
+	defer server.Close()
+	api, cleanup := newTestApi(t)
+	defer cleanup()
+
+	body, _ := json.Marshal(opts)
+	status, resp := doRequest(t, api, "POST", "/provision", string(body))
+	if status != http.StatusAccepted || resp.Job == nil {
+		t.Fatalf("Unexpected response %d %+v", status, resp)
+	}
+
+	job := waitForJob(t, api, resp.Job.Id)
+	if job.Status != JobSucceeded || job.Error != nil || job.Finished == nil {
+		t.Fatalf("Unexpected job %+v", job)
+	} else if job.Step != StepStartUpdateTimer {
+		t.Errorf("Expected last step %s, got %s", StepStartUpdateTimer, job.Step)
+	}
+
+	conf, err := api.readConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// There's no dashboard for the fake API.
+	if job.Device == nil || job.Device.Uuid != conf.Uuid || job.Device.Id != conf.DeviceId ||
+		job.Device.Url != "" {
+		t.Errorf("Unexpected device %+v", job.Device)
+	}
+
+	if status, resp := doRequest(t, api, "GET", "/jobs", ""); status != http.StatusOK ||
+		len(resp.Jobs) != 1 || resp.Jobs[0].Id != job.Id {
+		t.Errorf("Unexpected job list %d %+v", status, resp)
+	}
+	if status, resp := doRequest(t, api, "GET", "/jobs/unknown", ""); status != http.StatusNotFound ||
+		resp.Error == nil || resp.Error.Code != ErrorNotFound {
+		t.Errorf("Unexpected response for unknown job %d %+v", status, resp)
+	}
+}
+
+func TestProvisionJobFailure(t *testing.T) {
+	defer withResinServices(t, "resin-supervisor.service\n")()
+	server, opts := newTestServer(t)
+	defer server.Close()
+	api, cleanup := newTestApi(t)
+	defer cleanup()
+
+	server.Inject(resintest.Fault{Method: "POST", Path: "/v1/device", Status: 400,
+		Body: "upstream detail"})
+	job, err := api.StartProvision(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job = waitForJob(t, api, job.Id)
+	if job.Status != JobFailed || job.Error == nil || job.Error.Code != ErrorResinApi {
+		t.Errorf("Unexpected job %+v", job)
+	} else if strings.Contains(job.Error.Message, "upstream detail") {
+		t.Errorf("Upstream response exposed by job: %s", job.Error.Message)
+	} else if job.Step != StepRegisterDevice {
+		t.Errorf("Expected failure at %s, got %s", StepRegisterDevice, job.Step)
+	} else if job.Device != nil {
+		t.Errorf("Unexpected device %+v", job.Device)
+	}
+}
+
+func TestProvisionJobWhileLocked(t *testing.T) {
+	requireFileLock(t)
+	server, opts := newTestServer(t)
+	defer server.Close()
+	api, cleanup := newTestApi(t)
+	defer cleanup()
+
+	// Another process, e.g. the CLI or the bundle watcher, is provisioning.
+	other := New(api.ConfigPath)
+	body, _ := json.Marshal(opts)
+	if err := other.withLock(func() error {
+		status, resp := doRequest(t, api, "POST", "/provision", string(body))
+		if status != http.StatusConflict || resp.Error == nil || resp.Error.Code != ErrorConflict {
+			t.Errorf("Expected conflict, got %d %+v", status, resp)
+		} else if jobs := api.Jobs(); len(jobs) != 0 {
+			t.Errorf("Unexpected jobs %+v", jobs)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
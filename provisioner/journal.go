@@ -0,0 +1,141 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/resin-os/resin-provisioner/util"
+)
+
+// A named step in the provision flow. Progress through these is persisted to
+// a journal next to config.json so an interrupted provision can be re-run
+// without repeating completed steps.
+type ProvisionStep string
+
+const (
+	StepFetchKeys          ProvisionStep = "fetch-keys"
+	StepRegisterDevice     ProvisionStep = "register-device"
+	StepWriteConfig        ProvisionStep = "write-config"
+	StepEnableMountOverlay ProvisionStep = "enable-mount-overlay"
+	StepEnableServices     ProvisionStep = "enable-services"
+	StepRestartOpenvpn     ProvisionStep = "restart-openvpn"
+	StepStartUpdateTimer   ProvisionStep = "start-update-timer"
+)
+
+// Steps which populate config.json and register the device.
+var configSteps = []ProvisionStep{
+	StepFetchKeys,
+	StepRegisterDevice,
+	StepWriteConfig,
+}
+
+// Steps which enable and start the supervisor services, in order.
+var serviceSteps = []ProvisionStep{
+	StepEnableMountOverlay,
+	StepEnableServices,
+	StepRestartOpenvpn,
+	StepStartUpdateTimer,
+}
+
+type journal struct {
+	path string
+
+	Completed []ProvisionStep `json:"completed"`
+	// Name requested for the device when it is registered, if any.
+	DeviceName string `json:"deviceName,omitempty"`
+	// The result of registering the device is held here until the
+	// write-config step has persisted it to config.json.
+	DeviceId     int64 `json:"deviceId,omitempty"`
+	RegisteredAt int64 `json:"registeredAt,omitempty"`
+}
+
+func (a *Api) journalPath() string {
+	return a.ConfigPath + JOURNAL_SUFFIX
+}
+
+// Reads the journal, returning an empty one if none exists.
+func (a *Api) readJournal() (*journal, error) {
+	ret := &journal{path: a.journalPath()}
+
+	if bytes, err := ioutil.ReadFile(ret.path); os.IsNotExist(err) {
+		return ret, nil
+	} else if err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(bytes, ret); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// Starts a fresh journal, discarding any existing progress.
+func (a *Api) newJournal() (*journal, error) {
+	ret := &journal{path: a.journalPath()}
+
+	return ret, ret.remove()
+}
+
+func (j *journal) done(step ProvisionStep) bool {
+	for _, completed := range j.Completed {
+		if completed == step {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (j *journal) allDone(steps []ProvisionStep) bool {
+	for _, step := range steps {
+		if !j.done(step) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (j *journal) complete(step ProvisionStep) error {
+	j.Completed = append(j.Completed, step)
+
+	if bytes, err := json.Marshal(j); err != nil {
+		return err
+	} else {
+		return util.AtomicWrite(j.path, string(bytes))
+	}
+}
+
+func (j *journal) exists() bool {
+	_, err := os.Stat(j.path)
+
+	return err == nil
+}
+
+func (j *journal) remove() error {
+	if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// Runs each of the specified steps not already completed according to the
+// journal, recording each as it completes.
+func runSteps(j *journal, steps []ProvisionStep, run func(ProvisionStep) error) error {
+	for _, step := range steps {
+		if j.done(step) {
+			continue
+		}
+
+		if err := run(step); err != nil {
+			return err
+		}
+
+		if err := j.complete(step); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package provisioner
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	pathLib "path"
+	"testing"
+)
+
+// Ensure a re-run after a failure only repeats incomplete steps.
+func TestRunStepsResumes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "provisioner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	api := New(pathLib.Join(dir, "config.json"))
+	j, err := api.readJournal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ran []ProvisionStep
+	fail := StepRegisterDevice
+	run := func(step ProvisionStep) error {
+		ran = append(ran, step)
+		if step == fail {
+			return errors.New("failed")
+		}
+		return nil
+	}
+
+	if err := runSteps(j, configSteps, run); err == nil {
+		t.Fatal("Expected failure on first run")
+	}
+
+	// Pick up the persisted journal as a fresh process would.
+	if j, err = api.readJournal(); err != nil {
+		t.Fatal(err)
+	}
+	ran, fail = nil, ""
+	if err := runSteps(j, configSteps, run); err != nil {
+		t.Fatalf("Second run failed: %s", err)
+	}
+
+	if len(ran) != 2 || ran[0] != StepRegisterDevice || ran[1] != StepWriteConfig {
+		t.Errorf("Unexpected steps run on resume: %v", ran)
+	}
+	if !j.allDone(configSteps) {
+		t.Error("Not all steps recorded as done")
+	}
+}
@@ -1,48 +1,251 @@
 package provisioner
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"reflect"
 	"strings"
 )
 
-// Avoid screwing up numbers when unmarshalling (i.e. decoding).
-// See http://stackoverflow.com/a/22346593
-func unmarshalRawSafe(str string, out *map[string]interface{}) error {
-	reader := strings.NewReader(str)
-	decoder := json.NewDecoder(reader)
-	// The key to fixing the issue. Forces decoding into json.Number rather
-	// than a possible float64 if it feels like it.
-	decoder.UseNumber()
+// A member of a JSON object, located by offsets into the document.
+type jsonMember struct {
+	key string
+	// Whitespace preceding the key.
+	lead                                   string
+	keyStart, keyEnd, valueStart, valueEnd int
+}
 
-	return decoder.Decode(out)
+func skipSpace(data []byte, i int) int {
+	for i < len(data) && strings.IndexByte(" \t\r\n", data[i]) >= 0 {
+		i++
+	}
+	return i
 }
 
-func stringifyConfig(conf *Config) (string, error) {
-	var exportedRaw map[string]interface{}
+// Returns the offset just past the JSON value starting at data[i].
+func skipValue(data []byte, i int) int {
+	depth := 0
+	inString := false
+
+	for ; i < len(data); i++ {
+		c := data[i]
+		if inString {
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				inString = false
+				if depth == 0 {
+					return i + 1
+				}
+			}
+		} else if c == '"' {
+			inString = true
+		} else if c == '{' || c == '[' {
+			depth++
+		} else if c == '}' || c == ']' {
+			depth--
+			if depth <= 0 {
+				// A scalar is also ended by its parent's close.
+				if depth < 0 {
+					return i
+				}
+				return i + 1
+			}
+		} else if depth == 0 && strings.IndexByte(", \t\r\n", c) >= 0 {
+			return i
+		}
+	}
+
+	return i
+}
+
+// Locates the members of the JSON object in data, returning them along with
+// the offsets of the object's braces.
+func scanObject(data []byte) (members []jsonMember, open, close int, err error) {
+	invalid := errors.New("Invalid JSON object")
+
+	if open = skipSpace(data, 0); open >= len(data) || data[open] != '{' {
+		return nil, 0, 0, invalid
+	}
+
+	for i := open + 1; ; {
+		var m jsonMember
+
+		leadStart := i
+		if i = skipSpace(data, i); i < len(data) && data[i] == '}' && len(members) == 0 {
+			return members, open, i, nil
+		} else if i >= len(data) || data[i] != '"' {
+			return nil, 0, 0, invalid
+		}
+
+		m.lead = string(data[leadStart:i])
+		m.keyStart, m.keyEnd = i, skipValue(data, i)
+		if err := json.Unmarshal(data[m.keyStart:m.keyEnd], &m.key); err != nil {
+			return nil, 0, 0, err
+		}
+
+		if i = skipSpace(data, m.keyEnd); i >= len(data) || data[i] != ':' {
+			return nil, 0, 0, invalid
+		}
+		m.valueStart = skipSpace(data, i+1)
+		m.valueEnd = skipValue(data, m.valueStart)
+		members = append(members, m)
+
+		if i = skipSpace(data, m.valueEnd); i < len(data) && data[i] == ',' {
+			i++
+		} else if i < len(data) && data[i] == '}' {
+			return members, open, i, nil
+		} else {
+			return nil, 0, 0, invalid
+		}
+	}
+}
+
+// Compares JSON values, without screwing up numbers by decoding them as
+// float64. See http://stackoverflow.com/a/22346593
+func jsonEqual(a, b []byte) bool {
+	var aVal, bVal interface{}
+
+	decode := func(data []byte, out *interface{}) error {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		return decoder.Decode(out)
+	}
+	if decode(a, &aVal) != nil || decode(b, &bVal) != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(aVal, bVal)
+}
 
-	// This forms part of the overall approach to avoid accidentally
-	// stripping new JSON fields, see parseConfig() comments for more
-	// details.
+// Serialises the config by editing the JSON it was parsed from, so that
+// fields the provisioner doesn't know about, key order, formatting and
+// values which haven't changed are left exactly as they were.
+func stringifyConfig(conf *Config) (string, error) {
+	var exported map[string]json.RawMessage
 
-	// HACK: We marshal then unmarshal the config file to get a
-	// map[string]interface{} representation of the exported fields so we
-	// can more easily overlay the existing raw data.
-	if bytes, err := json.Marshal(conf); err != nil {
+	if data, err := json.Marshal(conf); err != nil {
 		return "", err
-	} else if err := unmarshalRawSafe(string(bytes), &exportedRaw); err != nil {
+	} else if err := json.Unmarshal(data, &exported); err != nil {
 		return "", err
 	}
 
-	// We are mutating this field but it's fine.
-	raw := conf.InitialRaw
-	for name, val := range exportedRaw {
-		// TODO: Deal with nested structs correctly.
-		raw[name] = val
+	initial := conf.InitialJson
+	if len(initial) == 0 {
+		initial = []byte("{}")
+	}
+	members, open, close, err := scanObject(initial)
+	if err != nil {
+		return "", err
+	}
+
+	fields := configFieldNames()
+	isField := make(map[string]bool)
+	for _, name := range fields {
+		isField[name] = true
 	}
 
-	bytes, err := json.Marshal(raw)
+	var out bytes.Buffer
+	count := 0
+	write := func(lead string, parts ...[]byte) {
+		if count > 0 {
+			out.WriteByte(',')
+		}
+		out.WriteString(lead)
+		for _, part := range parts {
+			out.Write(part)
+		}
+		count++
+	}
+
+	out.Write(initial[:open+1])
+
+	// Where a field is duplicated the last occurrence is the one which was
+	// parsed, so that's the one we keep.
+	last := make(map[string]int)
+	for i, m := range members {
+		last[m.key] = i
+	}
 
-	return string(bytes), err
+	// New members are formatted like the last existing one.
+	lead, sep := "", []byte(":")
+	seen := make(map[string]bool)
+	for i, m := range members {
+		lead, sep = m.lead, initial[m.keyEnd:m.valueStart]
+		value, ok := exported[m.key]
+		seen[m.key] = true
+
+		if !isField[m.key] {
+			write(m.lead, initial[m.keyStart:m.valueEnd])
+		} else if !ok || last[m.key] != i {
+			// Exported fields omitted from the output due to
+			// omitempty have been cleared, so make sure we don't
+			// resurrect their old values. Earlier duplicates are
+			// dropped too.
+			continue
+		} else if jsonEqual(initial[m.valueStart:m.valueEnd], value) {
+			write(m.lead, initial[m.keyStart:m.valueEnd])
+		} else {
+			write(m.lead, initial[m.keyStart:m.valueStart], value)
+		}
+	}
+
+	for _, name := range fields {
+		if value, ok := exported[name]; ok && !seen[name] {
+			key, _ := json.Marshal(name)
+			write(lead, key, sep, value)
+		}
+	}
+
+	if len(members) > 0 {
+		out.Write(initial[members[len(members)-1].valueEnd:close])
+	} else {
+		out.Write(initial[open+1 : close])
+	}
+	out.Write(initial[close:])
+
+	return out.String(), nil
+}
+
+// Returns the JSON name of a Config field, empty if it isn't serialised.
+func configFieldName(field reflect.StructField) string {
+	if name := strings.Split(field.Tag.Get("json"), ",")[0]; name != "-" {
+		return name
+	}
+	return ""
+}
+
+func isSensitive(field reflect.StructField) bool {
+	return field.Tag.Get("sensitive") == "true"
+}
+
+// Returns the JSON names of all exported Config fields.
+func configFieldNames() []string {
+	var ret []string
+
+	typ := reflect.TypeOf(Config{})
+	for i := 0; i < typ.NumField(); i++ {
+		if name := configFieldName(typ.Field(i)); name != "" {
+			ret = append(ret, name)
+		}
+	}
+
+	return ret
+}
+
+// Returns the JSON names of Config fields holding secrets.
+func sensitiveConfigFields() map[string]bool {
+	ret := make(map[string]bool)
+
+	typ := reflect.TypeOf(Config{})
+	for i := 0; i < typ.NumField(); i++ {
+		if name := configFieldName(typ.Field(i)); name != "" && isSensitive(typ.Field(i)) {
+			ret[name] = true
+		}
+	}
+
+	return ret
 }
 
 func parseProvisionOpts(str string) (*ProvisionOpts, error) {
@@ -51,33 +254,25 @@ func parseProvisionOpts(str string) (*ProvisionOpts, error) {
 	return ret, json.Unmarshal([]byte(str), ret)
 }
 
+func parseDeprovisionOpts(str string) (*DeprovisionOpts, error) {
+	ret := new(DeprovisionOpts)
+
+	return ret, json.Unmarshal([]byte(str), ret)
+}
+
 func parseConfig(str string, domain string) (*Config, error) {
-	bytes := []byte(str)
 	ret := new(Config)
 	*ret = DefaultConfig
 
-	// We parse it twice, firstly we populate the struct fileds in the usual
-	// way:
-	if err := json.Unmarshal(bytes, ret); err != nil {
+	if err := json.Unmarshal([]byte(str), ret); err != nil {
 		return nil, err
 	}
 
-	// Next, we populate the 'Raw' fields as map[string]interface{} values:
-	if err := unmarshalRawSafe(string(bytes), &ret.InitialRaw); err != nil {
-		return nil, err
-	}
-
-	// These fields will NOT be synced by default, however on stringify we
-	// will overlay InitialRaw with values taken from the fields and
-	// generate a combination of the two.
-
-	// This way we avoid stripping newly created fields in config.json when
-	// we only wanted to update existing known ones.
-
-	// IMPORTANT: This won't work for any nested structs as we simply
-	// overwrite exported fields in the generated output, more work would
-	// need to be done to deal with that which isn't hugely worth it for the
-	// provisioner.
+	// Keep the original JSON so that on stringify we only edit the fields
+	// we changed. This way we avoid stripping newly created fields in
+	// config.json, or reformatting nested sections, when we only wanted to
+	// update existing known ones.
+	ret.InitialJson = []byte(str)
 
 	// If DeviceType not specified, attempt to detect it.
 	if err := ret.DetectDeviceType(); err != nil {
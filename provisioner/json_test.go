@@ -2,7 +2,10 @@ package provisioner
 
 import (
 	"log"
+	"strings"
 	"testing"
+
+	"github.com/resin-os/resin-provisioner/resin/resintest"
 )
 
 var minimalJson = `
@@ -48,15 +51,102 @@ func TestParseMinimalConfigJson(t *testing.T) {
 }
 
 func TestGetConfigFromApi(t *testing.T) {
+	server := resintest.NewServer()
+	defer server.Close()
+
 	var c Config
-	c.ApiEndpoint = "https://api.resin.io"
+	c.ApiEndpoint = server.URL
 	if err := c.GetKeysFromApi(); err != nil {
 		t.Errorf("Error getting from API: %s", err)
 	} else {
 		log.Printf("%v %v %v", c.MixpanelToken, c.PubnubSubscribeKey, c.PubnubPublishKey)
-		if c.MixpanelToken == "" || c.PubnubSubscribeKey == "" || c.PubnubSubscribeKey == "" {
+		if c.MixpanelToken == "" || c.PubnubPublishKey == "" || c.PubnubSubscribeKey == "" {
 			t.Error("Empty values after getting from API")
 		}
 	}
 
 }
+
+func TestStringifyConfigPreservesUnknownFields(t *testing.T) {
+	str := `{
+    "os": {"network": {"wifi": [{"ssid": "home", "psk": "s3cret"}]}, "ntp": ["pool.ntp.org"]},
+    "deviceType": "raspberrypi3",
+    "bigNumber": 123456789012345678901234567890,
+    "float": 1.50,
+    "applicationId": "123",
+    "registered_at": 1476889000,
+    "deviceId": 42
+}`
+	conf, err := parseConfig(str, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf.ApplicationId = "456"
+	conf.DeviceId = 0
+	out, err := stringifyConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything up to the changed field is untouched, unknown values
+	// included.
+	prefix := str[:strings.Index(str, `"applicationId"`)]
+	if !strings.HasPrefix(out, prefix) {
+		t.Errorf("Unchanged fields rewritten:\n%s", out)
+	}
+	if !strings.Contains(out, `
+    "applicationId": "456",
+    "registered_at": 1476889000`) {
+		t.Errorf("Changed field not updated in place:\n%s", out)
+	}
+	if strings.Contains(out, "deviceId") {
+		t.Errorf("Cleared field not removed:\n%s", out)
+	}
+	// Fields missing from the original are appended in the same style.
+	if !strings.Contains(out, `,
+    "listenPort": "48484"`) || !strings.HasSuffix(out, "\n}") {
+		t.Errorf("Missing fields not appended:\n%s", out)
+	}
+
+	// Re-parsing and writing without changes is a no-op.
+	if conf, err := parseConfig(out, ""); err != nil {
+		t.Fatalf("Invalid JSON written: %s\n%s", err, out)
+	} else if again, err := stringifyConfig(conf); err != nil {
+		t.Fatal(err)
+	} else if again != out {
+		t.Errorf("Unchanged config rewritten:\n%s\n%s", out, again)
+	}
+}
+
+func TestStringifyConfigDuplicateKeys(t *testing.T) {
+	conf, err := parseConfig(`{"uuid": "aa", "os": 1, "uuid": "bb", "os": 2}`, "")
+	if err != nil {
+		t.Fatal(err)
+	} else if conf.Uuid != "bb" {
+		t.Fatalf("Expected last uuid to be parsed, got %q", conf.Uuid)
+	}
+	conf.Uuid = "cc"
+
+	str, err := stringifyConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	members, _, _, err := scanObject([]byte(str))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var uuids []string
+	for _, m := range members {
+		if m.key == "uuid" {
+			uuids = append(uuids, str[m.valueStart:m.valueEnd])
+		}
+	}
+	if len(uuids) != 1 || uuids[0] != `"cc"` {
+		t.Errorf("Expected a single rewritten uuid, got %v in %s", uuids, str)
+	}
+	// Unknown fields are left alone.
+	if !strings.Contains(str, `"os": 1`) || !strings.Contains(str, `"os": 2`) {
+		t.Errorf("Unknown fields changed in %s", str)
+	}
+}
@@ -0,0 +1,16 @@
+package provisioner
+
+import (
+	"net"
+	"syscall"
+)
+
+// Creates a unix socket at path accessible only by us, so that no one else
+// can connect before setSocketPermissions gives it the mode asked for. The
+// umask is process wide, so this should only be done before serving.
+func listenUnix(path string) (net.Listener, error) {
+	old := syscall.Umask(0077)
+	defer syscall.Umask(old)
+
+	return net.Listen("unix", path)
+}
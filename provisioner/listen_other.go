@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package provisioner
+
+import (
+	"net"
+)
+
+func listenUnix(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
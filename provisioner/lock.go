@@ -0,0 +1,62 @@
+package provisioner
+
+import (
+	"errors"
+)
+
+func (a *Api) lockPath() string {
+	return a.ConfigPath + LOCK_SUFFIX
+}
+
+// Returned, as an ErrorConflict, when the provisioning lock is held.
+var errLocked = errors.New("Provisioning in progress.")
+
+func errInProgress() error {
+	return &Error{Code: ErrorConflict, Err: errLocked}
+}
+
+// Takes the provisioning lock, so that concurrent attempts to register the
+// device or rewrite config.json fail rather than interleave, returning a
+// function to release it. On Linux the lock is also an advisory lock on a file
+// next to config.json, so it excludes other processes, e.g. resin-provision
+// run alongside the server.
+func (a *Api) lock() (func(), error) {
+	a.lockMutex.Lock()
+	if a.locked {
+		a.lockMutex.Unlock()
+		return nil, errInProgress()
+	}
+	a.locked = true
+	a.lockMutex.Unlock()
+
+	unlock := func() {
+		a.lockMutex.Lock()
+		a.locked = false
+		a.lockMutex.Unlock()
+	}
+
+	release, err := lockFile(a.lockPath())
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+
+	return func() {
+		release()
+		unlock()
+	}, nil
+}
+
+// Runs f holding the provisioning lock.
+func (a *Api) withLock(f func() error) error {
+	release, err := a.lock()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// Let event subscribers know if that changed the state.
+	defer a.emitState()
+
+	return f()
+}
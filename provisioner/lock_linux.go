@@ -0,0 +1,27 @@
+package provisioner
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Takes an exclusive advisory lock on the file at path, failing with
+// errInProgress if another process holds it.
+func lockFile(path string) (func(), error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot open lock file: %s", err)
+	}
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errInProgress()
+		}
+		return nil, fmt.Errorf("Cannot lock %s: %s", path, err)
+	}
+
+	// Closing the file releases the lock.
+	return func() { file.Close() }, nil
+}
@@ -0,0 +1,49 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"testing"
+)
+
+// Skips tests relying on the lock excluding other processes, which it only
+// does on Linux.
+func requireFileLock(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Other processes are only locked out on Linux.")
+	}
+}
+
+func TestProvisionWhileLocked(t *testing.T) {
+	requireFileLock(t)
+	defer withResinServices(t, "resin-supervisor.service\n")()
+	api, cleanup := newTestApi(t)
+	defer cleanup()
+
+	server, status := startSlowProvision(t, api)
+	defer server.Close()
+	defer api.Cleanup()
+
+	otherServer, opts := newTestServer(t)
+	defer otherServer.Close()
+	body, _ := json.Marshal(opts)
+	if code, _ := doRequest(t, api, "POST", "/provision", string(body)); code != http.StatusConflict {
+		t.Errorf("Expected conflict provisioning concurrently, got status %d", code)
+	}
+
+	// Another process sharing config.json is excluded too.
+	other := New(api.ConfigPath)
+	other.Services = NewFakeServiceManager()
+	if err := other.Provision(opts); errorCode(err) != ErrorConflict {
+		t.Errorf("Expected conflict from another instance, got %v", err)
+	}
+
+	if s := <-status; s != http.StatusAccepted {
+		t.Fatalf("Expected first provision to start, got status %d", s)
+	} else if job := waitForJob(t, api, api.Jobs()[0].Id); job.Status != JobSucceeded {
+		t.Errorf("Expected first provision to succeed, got %+v", job)
+	} else if n := server.DeviceCount(); n != 1 {
+		t.Errorf("Expected 1 registered device, got %d", n)
+	}
+}
@@ -0,0 +1,119 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os/user"
+	"strconv"
+)
+
+// Credentials of the process at the other end of a unix socket connection.
+type peerCred struct {
+	Pid int32
+	Uid uint32
+	Gid uint32
+}
+
+type connContextKey struct{}
+
+// Stores the connection in the context of requests made over it, so handlers
+// can check who they're talking to.
+func connContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, conn)
+}
+
+// Returns the credentials of the process which made the request.
+func requestPeerCred(req *http.Request) (*peerCred, error) {
+	if conn, ok := req.Context().Value(connContextKey{}).(*net.UnixConn); !ok {
+		return nil, errors.New("Request not made over a unix socket.")
+	} else {
+		return getPeerCred(conn)
+	}
+}
+
+// Restricts callers by the credentials of the connecting process. Root is
+// always allowed.
+type PeerAuth struct {
+	Uids []uint32
+	Gids []uint32
+}
+
+func (p *PeerAuth) allowed(cred *peerCred) bool {
+	if cred.Uid == 0 {
+		return true
+	}
+	for _, uid := range p.Uids {
+		if cred.Uid == uid {
+			return true
+		}
+	}
+	for _, gid := range p.Gids {
+		if cred.Gid == gid {
+			return true
+		}
+	}
+
+	// SO_PEERCRED only gives the primary group, so check the user's
+	// supplementary groups too.
+	if len(p.Gids) == 0 {
+		return false
+	}
+	groups, err := userGroupIds(cred.Uid)
+	if err != nil {
+		log.Printf("ERROR: Can't look up groups of uid %d: %s\n", cred.Uid, err)
+		return false
+	}
+	for _, group := range groups {
+		for _, gid := range p.Gids {
+			if group == strconv.FormatUint(uint64(gid), 10) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Returns the ids of the groups the user belongs to. Overridden in tests.
+var userGroupIds = func(uid uint32) ([]string, error) {
+	if u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10)); err != nil {
+		return nil, err
+	} else {
+		return u.GroupIds()
+	}
+}
+
+// Checks the request was made by an allowed caller.
+func (p *PeerAuth) check(req *http.Request) error {
+	if cred, err := requestPeerCred(req); err != nil {
+		return newError(ErrorForbidden, "Cannot verify client credentials: %s", err)
+	} else if !p.allowed(cred) {
+		return newError(ErrorForbidden, "Client pid %d uid %d gid %d is not allowed.",
+			cred.Pid, cred.Uid, cred.Gid)
+	}
+
+	return nil
+}
+
+// Checks the request was made by root.
+func checkPrivileged(req *http.Request) error {
+	return new(PeerAuth).check(req)
+}
+
+// Rejects requests which could change the device's state from callers not
+// allowed by a.Auth. Read-only requests are open to all.
+func (a *Api) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		if a.Auth != nil && req.Method != "GET" && req.Method != "HEAD" {
+			if err := a.Auth.check(req); err != nil {
+				a.reportError(writer, req, err, "Permission denied.")
+				return
+			}
+		}
+
+		next.ServeHTTP(writer, req)
+	})
+}
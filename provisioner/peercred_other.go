@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package provisioner
+
+import (
+	"errors"
+	"net"
+)
+
+func getPeerCred(conn *net.UnixConn) (*peerCred, error) {
+	return nil, errors.New("Peer credentials are only supported on Linux.")
+}
@@ -0,0 +1,95 @@
+package provisioner
+
+import (
+	"encoding/json"
+)
+
+// Shown in place of values only known once provisioning has run.
+const PENDING = "<set on provision>"
+
+// A change to a config.json field. Values are JSON, empty if the field is
+// absent.
+type ConfigChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// Returns the changes provisioning with opts would make to config.json,
+// without registering the device or writing anything.
+func (a *Api) PreviewProvision(opts *ProvisionOpts) ([]ConfigChange, error) {
+	if state, err := a.State(); err != nil {
+		return nil, err
+	} else if state != Unprovisioned && !(state == Provisioning && opts.Force) {
+		return nil, newError(ErrorConflict, "Cannot preview provisioning, device is %s.", state)
+	}
+
+	conf, err := a.provisionConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := conf.GetKeysFromClient(a.ctx, a.resinClient(conf)); err != nil {
+		return nil, resinApiError(err)
+	}
+
+	// Values only known once the device is registered.
+	pending := map[string]bool{"deviceId": true, "registered_at": true}
+	if conf.Uuid == "" {
+		pending["uuid"] = true
+	}
+
+	// Compare the file as it is with what would be written, which
+	// includes any defaults missing from it.
+	current := conf.InitialJson
+	if len(current) == 0 {
+		current = []byte("{}")
+	}
+	written, err := stringifyConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return diffConfig(current, []byte(written), pending)
+}
+
+// Returns the config fields which differ between config.json contents, with
+// secrets redacted. Pending fields are always included, their new values shown
+// as PENDING.
+func diffConfig(old, new []byte, pending map[string]bool) ([]ConfigChange, error) {
+	var oldFields, newFields map[string]json.RawMessage
+
+	if err := json.Unmarshal(old, &oldFields); err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(new, &newFields); err != nil {
+		return nil, err
+	}
+
+	sensitive := sensitiveConfigFields()
+	redact := func(field string, value json.RawMessage) string {
+		if sensitive[field] && value != nil && string(value) != `""` {
+			return REDACTED
+		}
+		return string(value)
+	}
+
+	var ret []ConfigChange
+	for _, name := range configFieldNames() {
+		oldValue, newValue := oldFields[name], newFields[name]
+		if pending[name] {
+			ret = append(ret, ConfigChange{Field: name, Old: redact(name, oldValue), New: PENDING})
+			continue
+		} else if oldValue == nil && newValue == nil {
+			continue
+		} else if oldValue != nil && newValue != nil && jsonEqual(oldValue, newValue) {
+			continue
+		}
+
+		ret = append(ret, ConfigChange{
+			Field: name,
+			Old:   redact(name, oldValue),
+			New:   redact(name, newValue),
+		})
+	}
+
+	return ret, nil
+}
@@ -1,16 +1,55 @@
 package provisioner
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
 )
 
+// The envelope for all responses from the socket API.
+type response struct {
+	State      string          `json:"state"`
+	Error      *responseError  `json:"error,omitempty"`
+	Supervisor string          `json:"supervisor,omitempty"`
+	Config     json.RawMessage `json:"config,omitempty"`
+	// Changes a dry run would make to config.json.
+	Changes []ConfigChange `json:"changes,omitempty"`
+	Job     *Job           `json:"job,omitempty"`
+	Jobs    []Job          `json:"jobs,omitempty"`
+}
+
+type responseError struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+func unsupportedMethod(req *http.Request) error {
+	return newError(ErrorUnsupported, "Unsupported method %s.", req.Method)
+}
+
+func (a *Api) notFoundHandler(writer http.ResponseWriter, req *http.Request) {
+	a.writeResponse(http.StatusNotFound, writer, &response{
+		Error: &responseError{Code: ErrorNotFound,
+			Message: fmt.Sprintf("No route for %s %s.", req.Method, req.URL.Path)},
+	})
+}
+
+func (a *Api) methodNotAllowedHandler(writer http.ResponseWriter, req *http.Request) {
+	a.writeResponse(http.StatusMethodNotAllowed, writer, &response{
+		Error: &responseError{Code: ErrorUnsupported,
+			Message: fmt.Sprintf("Unsupported method %s for %s.", req.Method, req.URL.Path)},
+	})
+}
+
 func (a *Api) provisionedHandler(writer http.ResponseWriter, req *http.Request) {
-	if str, err := a.StateJson(); err != nil {
-		reportError(404, writer, req, err,
+	if state, err := a.State(); err != nil {
+		a.reportError(writer, req, err,
 			"Can't read provisioned status.")
 	} else {
-		fmt.Fprintf(writer, str)
+		a.writeResponse(http.StatusOK, writer, &response{State: state.String()})
 	}
 }
 
@@ -19,34 +58,110 @@ func (a *Api) provisionHandler(writer http.ResponseWriter, req *http.Request) {
 	case "GET":
 		a.provisionedHandler(writer, req)
 	case "POST":
-		if str := readPostBodyReportErr(writer, req); str == "" {
+		if str := a.readPostBodyReportErr(writer, req); str == "" {
 			return
 		} else if opts, err := parseProvisionOpts(str); err != nil {
-			reportError(404, writer, req, err,
+			a.reportError(writer, req,
+				&Error{Code: ErrorInvalidOptions, Err: err},
 				"Invalid options specified.")
-		} else if err := a.Provision(opts); err != nil {
-			reportError(404, writer, req, err,
-				"Provision failed.")
+		} else if dryRun, _ := strconv.ParseBool(req.URL.Query().Get("dryRun")); dryRun {
+			a.previewReportErr(writer, req, opts)
+		} else {
+			a.provisionReportErr(writer, req, opts)
+		}
+	case "DELETE":
+		opts := new(DeprovisionOpts)
+		// Options are optional here, so an empty body is fine.
+		if str, err := readerToString(req.Body); err != nil {
+			a.reportError(writer, req, err,
+				"Can't convert read to string")
+			return
+		} else if str != "" {
+			if opts, err = parseDeprovisionOpts(str); err != nil {
+				a.reportError(writer, req,
+					&Error{Code: ErrorInvalidOptions, Err: err},
+					"Invalid options specified.")
+				return
+			}
+		}
+
+		if err := a.runCritical(func() error { return a.Deprovision(opts) }); err != nil {
+			a.reportError(writer, req, err, "Deprovision failed.")
+		} else {
+			a.writeResponse(http.StatusOK, writer, &response{})
 		}
 
 	default:
 		// Shouldn't be possible.
-		reportError(400, writer, req,
-			fmt.Errorf("Unsupported method %s.", req.Method), "")
+		a.reportError(writer, req, unsupportedMethod(req), "")
+	}
+}
+
+// Starts provisioning in the background, responding with the job so the client
+// can poll GET /jobs/{id} rather than hold the request open.
+func (a *Api) provisionReportErr(writer http.ResponseWriter, req *http.Request,
+	opts *ProvisionOpts) {
+	if job, err := a.StartProvision(opts); err != nil {
+		a.reportError(writer, req, err, "Provision failed.")
+	} else {
+		writer.Header().Set("Location", "/jobs/"+job.Id)
+		a.writeResponse(http.StatusAccepted, writer, &response{Job: job})
+	}
+}
+
+func (a *Api) previewReportErr(writer http.ResponseWriter, req *http.Request,
+	opts *ProvisionOpts) {
+	if changes, err := a.PreviewProvision(opts); err != nil {
+		a.reportError(writer, req, err, "Provision preview failed.")
+	} else {
+		a.writeResponse(http.StatusOK, writer, &response{Changes: changes})
+	}
+}
+
+func (a *Api) bundleHandler(writer http.ResponseWriter, req *http.Request) {
+	if str := a.readPostBodyReportErr(writer, req); str == "" {
+		return
+	} else if bundle, err := ParseBundle(str); err != nil {
+		a.reportError(writer, req, err, "Invalid bundle specified.")
+	} else {
+		a.provisionReportErr(writer, req, bundle.ProvisionOpts())
 	}
 }
 
 func (a *Api) configHandler(writer http.ResponseWriter, req *http.Request) {
 	if req.Method != "GET" {
 		// Shouldn't be possible.
-		reportError(400, writer, req,
-			fmt.Errorf("Unsupported method %s.", req.Method), "")
+		a.reportError(writer, req, unsupportedMethod(req), "")
 		return
 	}
 
-	if str, err := a.ConfigJson(); err != nil {
-		reportError(404, writer, req, err, "Can't read config.json.")
+	// Secrets are redacted unless root explicitly asks for them.
+	var str string
+	var err error
+	if raw, _ := strconv.ParseBool(req.URL.Query().Get("raw")); !raw {
+		str, err = a.RedactedConfigJson()
+	} else if err = checkPrivileged(req); err == nil {
+		str, err = a.ConfigJson()
+	}
+
+	if err != nil {
+		a.reportError(writer, req, err, "Can't read config.json.")
+	} else {
+		a.writeResponse(http.StatusOK, writer, &response{
+			Config: json.RawMessage(str),
+		})
+	}
+}
+
+func (a *Api) jobsHandler(writer http.ResponseWriter, req *http.Request) {
+	a.writeResponse(http.StatusOK, writer, &response{Jobs: a.Jobs()})
+}
+
+func (a *Api) jobHandler(writer http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	if job := a.Job(id); job == nil {
+		a.reportError(writer, req, newError(ErrorNotFound, "No job %s.", id), "")
 	} else {
-		fmt.Fprintf(writer, str)
+		a.writeResponse(http.StatusOK, writer, &response{Job: job})
 	}
 }
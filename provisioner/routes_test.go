@@ -0,0 +1,173 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	pathLib "path"
+	"strings"
+	"testing"
+)
+
+func newTestApi(t *testing.T) (*Api, func()) {
+	dir, err := ioutil.TempDir("", "provisioner")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configPath := pathLib.Join(dir, "config.json")
+	if err := ioutil.WriteFile(configPath, []byte(minimalJson), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	api := New(configPath)
+	api.Services = NewFakeServiceManager()
+
+	return api, func() { os.RemoveAll(dir) }
+}
+
+func doRequest(t *testing.T, api *Api, method, path, body string) (int, *response) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	api.server.Handler.ServeHTTP(rec, req)
+
+	resp := new(response)
+	if err := json.Unmarshal(rec.Body.Bytes(), resp); err != nil {
+		t.Fatalf("Invalid JSON response %q: %s", rec.Body.String(), err)
+	}
+
+	return rec.Code, resp
+}
+
+func TestProvisionedRoute(t *testing.T) {
+	api, cleanup := newTestApi(t)
+	defer cleanup()
+
+	if status, resp := doRequest(t, api, "GET", "/provisioned", ""); status != http.StatusOK {
+		t.Errorf("Unexpected status %d", status)
+	} else if resp.State != Unprovisioned.String() || resp.Error != nil {
+		t.Errorf("Unexpected response %+v", resp)
+	}
+}
+
+func TestUnknownRoutes(t *testing.T) {
+	api, cleanup := newTestApi(t)
+	defer cleanup()
+
+	if status, resp := doRequest(t, api, "GET", "/unknown", ""); status != http.StatusNotFound ||
+		resp.Error == nil || resp.Error.Code != ErrorNotFound {
+		t.Errorf("Unexpected response for unknown route %d %+v", status, resp)
+	}
+	if status, resp := doRequest(t, api, "PUT", "/config", ""); status != http.StatusMethodNotAllowed ||
+		resp.Error == nil || resp.Error.Code != ErrorUnsupported {
+		t.Errorf("Unexpected response for unsupported method %d %+v", status, resp)
+	}
+}
+
+func TestProvisionRouteInvalidOptions(t *testing.T) {
+	api, cleanup := newTestApi(t)
+	defer cleanup()
+
+	for _, body := range []string{
+		"{not json",
+		`{"userId": "abc", "applicationId": "123", "apikey": "key"}`,
+	} {
+		status, resp := doRequest(t, api, "POST", "/provision", body)
+		if status != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", body, status)
+		} else if resp.Error == nil || resp.Error.Code != ErrorInvalidOptions {
+			t.Errorf("%s: unexpected response %+v", body, resp)
+		} else if resp.State != Unprovisioned.String() {
+			t.Errorf("%s: unexpected state %s", body, resp.State)
+		}
+	}
+}
+
+func TestProvisionRouteDryRun(t *testing.T) {
+	server, opts := newTestServer(t)
+	defer server.Close()
+	api, cleanup := newTestApi(t)
+	defer cleanup()
+
+	before, err := ioutil.ReadFile(api.ConfigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := json.Marshal(opts)
+	status, resp := doRequest(t, api, "POST", "/provision?dryRun=true", string(body))
+	if status != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %+v", status, resp.Error)
+	}
+
+	changes := make(map[string]ConfigChange)
+	for _, change := range resp.Changes {
+		changes[change.Field] = change
+	}
+	if change := changes["applicationId"]; change.New != `"`+opts.ApplicationId+`"` {
+		t.Errorf("Unexpected applicationId change %+v", change)
+	}
+	if change := changes["apiKey"]; change.New != REDACTED {
+		t.Errorf("API key not redacted: %+v", change)
+	}
+	if change := changes["registered_at"]; change.New != PENDING {
+		t.Errorf("Unexpected registered_at change %+v", change)
+	}
+	// Defaults missing from the file will be written too.
+	if change := changes["vpnPort"]; change.Old != "" || change.New != `"`+DefaultConfig.VpnPort+`"` {
+		t.Errorf("Unexpected vpnPort change %+v", change)
+	}
+
+	if after, err := ioutil.ReadFile(api.ConfigPath); err != nil {
+		t.Fatal(err)
+	} else if string(after) != string(before) {
+		t.Error("Dry run modified config.json")
+	} else if n := server.DeviceCount(); n != 0 {
+		t.Errorf("Dry run registered %d devices", n)
+	} else if state, _ := api.State(); state != Unprovisioned {
+		t.Errorf("Unexpected state %s after dry run", state)
+	}
+}
+
+func TestConfigRouteRedactsSecrets(t *testing.T) {
+	api, cleanup := newTestApi(t)
+	defer cleanup()
+
+	conf, err := api.readConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.ApplicationId = "123"
+	conf.UserId = "456"
+	conf.ApiKey = "supersecretkey"
+	conf.Uuid = "abcdef"
+	if err := api.writeConfig(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	status, resp := doRequest(t, api, "GET", "/config", "")
+	if status != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %+v", status, resp.Error)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(resp.Config, &got); err != nil {
+		t.Fatal(err)
+	}
+	for name := range sensitiveConfigFields() {
+		if got[name] != REDACTED {
+			t.Errorf("%s not redacted: %v", name, got[name])
+		}
+	}
+	if got["applicationId"] != "123" {
+		t.Errorf("Unexpected applicationId %v", got["applicationId"])
+	}
+
+	// Not over a unix socket, so we can't tell the client is root.
+	if status, resp := doRequest(t, api, "GET", "/config?raw=true", ""); status != http.StatusForbidden {
+		t.Errorf("Expected raw config to be forbidden, got %d", status)
+	} else if strings.Contains(string(resp.Config), "supersecretkey") {
+		t.Error("Raw config returned")
+	}
+}
@@ -1,9 +1,16 @@
 package provisioner
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
 	"net"
 	"net/http"
+	"os"
+	"time"
 
+	"github.com/coreos/go-systemd/activation"
 	"github.com/gorilla/mux"
 )
 
@@ -11,24 +18,205 @@ func (a *Api) initServer() {
 	router := mux.NewRouter()
 
 	router.HandleFunc("/provisioned", a.provisionedHandler).Methods("GET")
-	router.HandleFunc("/provision", a.provisionHandler).Methods("GET", "POST")
+	router.HandleFunc("/provision", a.provisionHandler).Methods("GET", "POST", "DELETE")
+	router.HandleFunc("/provision/bundle", a.bundleHandler).Methods("POST")
 	router.HandleFunc("/config", a.configHandler).Methods("GET")
+	router.HandleFunc("/events", a.eventsHandler).Methods("GET")
+	router.HandleFunc("/jobs", a.jobsHandler).Methods("GET")
+	router.HandleFunc("/jobs/{id}", a.jobHandler).Methods("GET")
+	router.NotFoundHandler = http.HandlerFunc(a.notFoundHandler)
+	router.MethodNotAllowedHandler = http.HandlerFunc(a.methodNotAllowedHandler)
 
-	a.server = &http.Server{Handler: router}
+	a.activeConns = make(map[net.Conn]bool)
+	a.server = &http.Server{
+		Handler:     a.authorize(router),
+		ConnContext: connContext,
+		ConnState:   a.trackConn,
+	}
 }
 
+// Serves the socket API until Shutdown. A socket passed by systemd
+// socket activation is used if there is one, otherwise one is created at path.
 func (a *Api) Serve(path string) (err error) {
-	if err = checkSocket(path); err != nil {
+	if a.listener, err = activationListener(); err != nil {
 		return
+	} else if a.listener == nil {
+		if err = checkSocket(path); err != nil {
+			return
+		} else if a.listener, err = listenUnix(path); err != nil {
+			return
+		} else if err = a.setSocketPermissions(path); err != nil {
+			a.listener.Close()
+			return
+		}
+	}
+
+	if a.IdleTimeout > 0 {
+		go a.closeWhenIdle()
 	}
 
-	if a.listener, err = net.Listen("unix", path); err == nil {
-		err = a.server.Serve(a.listener)
+	if err = a.server.Serve(a.listener); err == http.ErrServerClosed {
+		// Let Shutdown finish with in-flight requests.
+		<-a.stopped
+		err = a.shutdownErr
 	}
 
 	return
 }
 
+// Stops serving, waiting for in-flight requests and critical sections such as
+// provisioning to finish. If ctx expires first, requests to the Resin API are
+// aborted so that those operations fail cleanly between steps, and ctx's error
+// is returned once they have. Serve returns once this completes.
+func (a *Api) Shutdown(ctx context.Context) error {
+	a.shutdownOnce.Do(func() {
+		a.criticalMutex.Lock()
+		close(a.stopping)
+		a.criticalMutex.Unlock()
+
+		a.shutdownErr = a.shutdown(ctx)
+		close(a.stopped)
+	})
+
+	<-a.stopped
+	return a.shutdownErr
+}
+
+func (a *Api) shutdown(ctx context.Context) error {
+	// This also removes the socket if we created it.
+	err := a.server.Shutdown(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		a.critical.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("Shutdown timed out, aborting requests to the Resin API.")
+		a.Cancel()
+		<-done
+		err = ctx.Err()
+	}
+
+	a.Cancel()
+	return err
+}
+
+// Runs f as a critical section, which Shutdown waits for, failing if we're
+// shutting down.
+func (a *Api) runCritical(f func() error) error {
+	if err := a.enterCritical(); err != nil {
+		return err
+	}
+
+	defer a.critical.Done()
+	return f()
+}
+
+// Starts a critical section, which the caller must end with critical.Done,
+// failing if we're shutting down.
+func (a *Api) enterCritical() error {
+	a.criticalMutex.Lock()
+	defer a.criticalMutex.Unlock()
+
+	select {
+	case <-a.stopping:
+		return newError(ErrorUnavailable, "Shutting down.")
+	default:
+	}
+	a.critical.Add(1)
+
+	return nil
+}
+
+// Returns the sockets passed to us by systemd. Overridden in tests.
+var activationFiles = func() []*os.File { return activation.Files(true) }
+
+// Returns the socket passed to us by systemd, or nil if we weren't socket
+// activated. Its permissions are set by the socket unit.
+func activationListener() (net.Listener, error) {
+	files := activationFiles()
+	if len(files) == 0 {
+		return nil, nil
+	} else if len(files) > 1 {
+		return nil, fmt.Errorf("Expected 1 socket from systemd, got %d.", len(files))
+	}
+
+	// The listener has its own copy of the file descriptor.
+	defer files[0].Close()
+	if listener, err := net.FileListener(files[0]); err != nil {
+		return nil, err
+	} else if unixListener, ok := listener.(*net.UnixListener); !ok {
+		listener.Close()
+		return nil, errors.New("Socket from systemd is not a unix socket.")
+	} else {
+		// The socket file belongs to systemd, which may activate us
+		// through it again.
+		unixListener.SetUnlinkOnClose(false)
+		return unixListener, nil
+	}
+}
+
+// Records when requests start and finish, for closeWhenIdle.
+func (a *Api) trackConn(conn net.Conn, state http.ConnState) {
+	a.idleMutex.Lock()
+	defer a.idleMutex.Unlock()
+
+	if state == http.StateActive {
+		a.activeConns[conn] = true
+	} else {
+		delete(a.activeConns, conn)
+	}
+	a.lastActive = time.Now()
+}
+
+// Shuts the server down once no requests have been made for IdleTimeout, so
+// that a socket activated server exits when it's not needed.
+func (a *Api) closeWhenIdle() {
+	a.idleMutex.Lock()
+	a.lastActive = time.Now()
+	a.idleMutex.Unlock()
+
+	for {
+		a.idleMutex.Lock()
+		busy := len(a.activeConns) > 0
+		wait := a.IdleTimeout - time.Since(a.lastActive)
+		a.idleMutex.Unlock()
+
+		if busy || a.jobRunning() {
+			wait = a.IdleTimeout
+		} else if wait <= 0 {
+			log.Printf("No requests for %s, shutting down.", a.IdleTimeout)
+			a.Shutdown(context.Background())
+			return
+		}
+
+		select {
+		case <-a.stopping:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (a *Api) setSocketPermissions(path string) error {
+	if a.SocketMode != 0 {
+		if err := os.Chmod(path, a.SocketMode); err != nil {
+			return err
+		}
+	}
+	if a.SocketUid >= 0 || a.SocketGid >= 0 {
+		if err := os.Chown(path, a.SocketUid, a.SocketGid); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // Clean up the socket after use.
 func (a *Api) Cleanup() {
 	if a != nil && a.listener != nil {
@@ -0,0 +1,271 @@
+package provisioner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	pathLib "path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/resin-os/resin-provisioner/resin/resintest"
+)
+
+// Serves api on a temporary socket, returning a client for it.
+func serveTestSocket(t *testing.T, api *Api) *http.Client {
+	path := pathLib.Join(pathLib.Dir(api.ConfigPath), "provisioner.sock")
+	go api.Serve(path)
+
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, "unix", path)
+		},
+	}}
+}
+
+func TestPeerAuthAllowed(t *testing.T) {
+	auth := &PeerAuth{Uids: []uint32{1000}, Gids: []uint32{50}}
+	defer func(orig func(uint32) ([]string, error)) { userGroupIds = orig }(userGroupIds)
+	userGroupIds = func(uid uint32) ([]string, error) {
+		if uid == 1002 {
+			return []string{"1002", "50"}, nil
+		}
+		return []string{strconv.FormatUint(uint64(uid), 10)}, nil
+	}
+
+	for _, c := range []struct {
+		cred    peerCred
+		allowed bool
+	}{
+		{peerCred{Uid: 0, Gid: 0}, true},
+		{peerCred{Uid: 1000, Gid: 1000}, true},
+		{peerCred{Uid: 1001, Gid: 50}, true},
+		{peerCred{Uid: 1001, Gid: 1001}, false},
+		// A supplementary member of an allowed group.
+		{peerCred{Uid: 1002, Gid: 1002}, true},
+	} {
+		if allowed := auth.allowed(&c.cred); allowed != c.allowed {
+			t.Errorf("%+v: expected allowed %t, got %t", c.cred, c.allowed, allowed)
+		}
+	}
+}
+
+func TestServeAuthorizesPeer(t *testing.T) {
+	api, cleanup := newTestApi(t)
+	defer cleanup()
+	defer api.Cleanup()
+
+	api.SocketMode = 0600
+	api.Auth = &PeerAuth{Uids: []uint32{uint32(os.Getuid())}}
+	client := serveTestSocket(t, api)
+
+	// Allowed, so we get as far as validating the options.
+	resp, err := client.Post("http://provisioner/provision", "application/json",
+		strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", resp.StatusCode)
+	}
+
+	path := pathLib.Join(pathLib.Dir(api.ConfigPath), "provisioner.sock")
+	if info, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("Expected socket mode 0600, got %o", mode)
+	}
+}
+
+func TestServeCreatesPrivateSocket(t *testing.T) {
+	api, cleanup := newTestApi(t)
+	defer cleanup()
+	defer api.Cleanup()
+
+	// Without a mode the socket is left as created.
+	client := serveTestSocket(t, api)
+	resp, err := client.Get("http://provisioner/provisioned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	path := pathLib.Join(pathLib.Dir(api.ConfigPath), "provisioner.sock")
+	if info, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if mode := info.Mode().Perm(); mode&0077 != 0 {
+		t.Errorf("Socket created accessible by others, mode %o", mode)
+	}
+}
+
+func TestAuthorizeRejectsUnknownPeer(t *testing.T) {
+	api, cleanup := newTestApi(t)
+	defer cleanup()
+
+	// Requests not over a unix socket have no credentials to check.
+	api.Auth = new(PeerAuth)
+	if status, _ := doRequest(t, api, "POST", "/provision", "{}"); status != http.StatusForbidden {
+		t.Errorf("Expected status 403, got %d", status)
+	} else if status, _ := doRequest(t, api, "GET", "/provisioned", ""); status != http.StatusOK {
+		t.Errorf("Expected read-only route to be open, got %d", status)
+	}
+}
+
+func TestServeClosesWhenIdle(t *testing.T) {
+	api, cleanup := newTestApi(t)
+	defer cleanup()
+
+	api.IdleTimeout = 50 * time.Millisecond
+	path := pathLib.Join(pathLib.Dir(api.ConfigPath), "provisioner.sock")
+	done := make(chan error)
+	go func() { done <- api.Serve(path) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		api.Cleanup()
+		t.Fatal("Server not closed when idle")
+	}
+}
+
+func TestServeSocketActivated(t *testing.T) {
+	api, cleanup := newTestApi(t)
+	defer cleanup()
+	dir := pathLib.Dir(api.ConfigPath)
+
+	// Stand in for the socket systemd would pass us.
+	activated := pathLib.Join(dir, "activated.sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: activated, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := listener.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.SetUnlinkOnClose(false)
+	listener.Close()
+
+	prev := activationFiles
+	defer func() { activationFiles = prev }()
+	activationFiles = func() []*os.File { return []*os.File{file} }
+
+	unused := pathLib.Join(dir, "provisioner.sock")
+	done := make(chan error, 1)
+	go func() { done <- api.Serve(unused) }()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, "unix", activated)
+		},
+	}}
+	if resp, err := client.Get("http://provisioner/provisioned"); err != nil {
+		t.Fatalf("Request over activated socket failed: %s", err)
+	} else {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Unexpected status %d", resp.StatusCode)
+		}
+	}
+	if _, err := os.Stat(unused); !os.IsNotExist(err) {
+		t.Errorf("Socket created at %s despite activation", unused)
+	}
+
+	if err := api.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown failed: %s", err)
+	} else if err := <-done; err != nil {
+		t.Errorf("Serve failed: %s", err)
+	}
+	api.Cleanup()
+
+	// systemd owns the socket file, so it must survive us.
+	if _, err := os.Stat(activated); err != nil {
+		t.Errorf("Activated socket removed: %s", err)
+	}
+}
+
+// Starts a provision over the socket against a slow API, returning once it is
+// under way along with a channel receiving its response status.
+func startSlowProvision(t *testing.T, api *Api) (*resintest.Server, <-chan int) {
+	server, opts := newTestServer(t)
+	server.SetLatency(200 * time.Millisecond)
+	client := serveTestSocket(t, api)
+
+	body, _ := json.Marshal(opts)
+	status := make(chan int, 1)
+	go func() {
+		if resp, err := client.Post("http://provisioner/provision", "application/json",
+			bytes.NewReader(body)); err != nil {
+			status <- 0
+		} else {
+			resp.Body.Close()
+			status <- resp.StatusCode
+		}
+	}()
+
+	for len(server.Requests()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return server, status
+}
+
+func TestShutdownWaitsForProvision(t *testing.T) {
+	defer withResinServices(t, "resin-supervisor.service\n")()
+	api, cleanup := newTestApi(t)
+	defer cleanup()
+
+	server, status := startSlowProvision(t, api)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := api.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown failed: %s", err)
+	}
+
+	if s := <-status; s != http.StatusAccepted {
+		t.Errorf("Expected provision to start, got status %d", s)
+	} else if jobs := api.Jobs(); len(jobs) != 1 || jobs[0].Status != JobSucceeded {
+		t.Errorf("Expected provision to succeed, got jobs %+v", jobs)
+	} else if state, _ := api.State(); state != Provisioned {
+		t.Errorf("Unexpected state %s after shutdown", state)
+	}
+}
+
+func TestShutdownAbortsProvisionAfterDeadline(t *testing.T) {
+	defer withResinServices(t, "resin-supervisor.service\n")()
+	api, cleanup := newTestApi(t)
+	defer cleanup()
+
+	server, status := startSlowProvision(t, api)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := api.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+	<-status
+
+	// The provision stopped between steps, so can be resumed.
+	if state, _ := api.State(); state != Unprovisioned && state != Provisioning {
+		t.Errorf("Unexpected state %s after aborted provision", state)
+	}
+}
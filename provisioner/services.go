@@ -0,0 +1,155 @@
+package provisioner
+
+import (
+	"fmt"
+
+	"github.com/resin-os/resin-provisioner/util"
+)
+
+// Manages the system services the provisioner enables and starts. Units are
+// referred to by the path of their unit file, e.g. SUPERVISOR_PATH.
+type ServiceManager interface {
+	EnableUnits(paths []string) error
+	DisableUnits(paths []string) error
+	// Starts a unit, blocking until it has started.
+	StartUnit(path string) error
+	// Stops a unit, blocking until it has stopped.
+	StopUnit(path string) error
+	// Restarts a unit without waiting for the restart to complete.
+	RestartUnit(path string) error
+	// Returns the unit's status, or nil if the unit is not known.
+	UnitStatus(path string) (*UnitStatus, error)
+	Close()
+}
+
+type UnitStatus struct {
+	Name        string
+	LoadState   string
+	ActiveState string
+	SubState    string
+}
+
+// Returned when a device has been registered but the supervisor services
+// could not all be started.
+type SupervisorError struct {
+	Step ProvisionStep
+	Err  error
+}
+
+func (e *SupervisorError) Error() string {
+	return fmt.Sprintf("Cannot start supervisor, %s failed: %s", e.Step, e.Err)
+}
+
+// The file listing the resin services to enable. Overridden in tests.
+var ResinServicesPath = RESIN_SERVICES_PATH
+
+// Returns the service manager to use, connecting to systemd if the Api wasn't
+// given one. The returned function releases it after use.
+func (a *Api) services() (ServiceManager, func(), error) {
+	if a.Services != nil {
+		return a.Services, func() {}, nil
+	}
+
+	if conn, err := NewDbus(); err != nil {
+		return nil, nil, err
+	} else {
+		return conn, conn.Close, nil
+	}
+}
+
+func resinServicePaths() ([]string, error) {
+	if services, err := util.ReadLines(ResinServicesPath); err != nil {
+		return nil, err
+	} else {
+		paths := make([]string, len(services))
+
+		for i, service := range services {
+			paths[i] = fmt.Sprintf("%s%s", SERVICES_ROOT_PATH, service)
+		}
+
+		return paths, nil
+	}
+}
+
+func EnableStartUnit(m ServiceManager, path string) error {
+	if err := m.EnableUnits([]string{path}); err != nil {
+		return err
+	}
+
+	return m.StartUnit(path)
+}
+
+func EnableResinServices(m ServiceManager) error {
+	if paths, err := resinServicePaths(); err != nil {
+		return err
+	} else {
+		return m.EnableUnits(paths)
+	}
+}
+
+func SupervisorRunning(m ServiceManager) (bool, error) {
+	if status, err := m.UnitStatus(SUPERVISOR_PATH); err != nil {
+		return false, err
+	} else {
+		running := status != nil &&
+			status.LoadState == "loaded" &&
+			status.ActiveState == "active"
+
+		return running, nil
+	}
+}
+
+func runServiceStep(m ServiceManager, step ProvisionStep) error {
+	switch step {
+	case StepEnableMountOverlay:
+		// Start by enabling the mount overlay service
+		return EnableStartUnit(m, MOUNT_OVERLAY_PATH)
+	case StepEnableServices:
+		// Enabling all required services.
+		return EnableResinServices(m)
+	case StepRestartOpenvpn:
+		// We need to restart the prepare-openvpn.service ('wanted' by
+		// openvpn-resin.service) to avoid a bug whereby config.json is
+		// read before endpoints are populated, resulting in
+		// misconfigured openvpn.
+		return m.RestartUnit(OPENVPN_PATH)
+	case StepStartUpdateTimer:
+		// Start the resin update timer too.
+		return EnableStartUnit(m, UPDATE_RESIN_TIMER_PATH)
+	}
+
+	return fmt.Errorf("Unknown step %s.", step)
+}
+
+func SupervisorEnableStart(m ServiceManager) error {
+	for _, step := range serviceSteps {
+		if err := runServiceStep(m, step); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func SupervisorStopDisable(m ServiceManager) error {
+	paths, err := resinServicePaths()
+	if err != nil {
+		return err
+	}
+
+	// Stop the update timer first so it can't restart the supervisor
+	// from underneath us.
+	if err := m.StopUnit(UPDATE_RESIN_TIMER_PATH); err != nil {
+		return err
+	}
+	if err := m.StopUnit(SUPERVISOR_PATH); err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := m.StopUnit(path); err != nil {
+			return err
+		}
+	}
+
+	return m.DisableUnits(append(paths, UPDATE_RESIN_TIMER_PATH))
+}
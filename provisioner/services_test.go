@@ -0,0 +1,65 @@
+package provisioner
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func withResinServices(t *testing.T, services string) func() {
+	file, err := ioutil.TempFile("", "resin-connectable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteString(services); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	prev := ResinServicesPath
+	ResinServicesPath = file.Name()
+
+	return func() {
+		ResinServicesPath = prev
+		os.Remove(file.Name())
+	}
+}
+
+func TestSupervisorEnableStartOrdering(t *testing.T) {
+	defer withResinServices(t, "resin-supervisor.service\nopenvpn-resin.service\n")()
+
+	fake := NewFakeServiceManager()
+	if err := SupervisorEnableStart(fake); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"enable etc-systemd-system-resin.target.wants.mount",
+		"start etc-systemd-system-resin.target.wants.mount",
+		"enable resin-supervisor.service",
+		"enable openvpn-resin.service",
+		"restart openvpn-resin.service",
+		"enable update-resin-supervisor.timer",
+		"start update-resin-supervisor.timer",
+	}
+	if !reflect.DeepEqual(fake.Calls, expected) {
+		t.Errorf("Unexpected calls:\n%v\nexpected:\n%v", fake.Calls, expected)
+	}
+}
+
+func TestSupervisorEnableStartStopsOnError(t *testing.T) {
+	defer withResinServices(t, "resin-supervisor.service\n")()
+
+	fake := NewFakeServiceManager()
+	fake.Errors["restart openvpn-resin.service"] = errors.New("failed")
+	if err := SupervisorEnableStart(fake); err == nil {
+		t.Fatal("Expected error")
+	}
+
+	last := fake.Calls[len(fake.Calls)-1]
+	if last != "restart openvpn-resin.service" {
+		t.Errorf("Continued after failure, last call: %s", last)
+	}
+}
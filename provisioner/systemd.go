@@ -5,10 +5,9 @@ import (
 	pathLib "path"
 
 	"github.com/coreos/go-systemd/dbus"
-
-	"github.com/resin-os/resin-provisioner/util"
 )
 
+// The systemd ServiceManager, talking to systemd over the system bus.
 type dbusConnection struct {
 	*dbus.Conn
 }
@@ -23,9 +22,10 @@ func NewDbus() (ret *dbusConnection, err error) {
 	return
 }
 
-func (c *dbusConnection) UnitStatus(name string) (status *dbus.UnitStatus, err error) {
+func (c *dbusConnection) UnitStatus(path string) (status *UnitStatus, err error) {
 	var statuses []dbus.UnitStatus
 
+	name := pathLib.Base(path)
 	if statuses, err = c.ListUnitsByNames([]string{name}); err == nil {
 		if len(statuses) == 0 {
 			return
@@ -34,93 +34,71 @@ func (c *dbusConnection) UnitStatus(name string) (status *dbus.UnitStatus, err e
 			err = fmt.Errorf("%d units returned for name '%s', expected 1.",
 				len(statuses), name)
 		} else {
-			status = &statuses[0]
+			status = &UnitStatus{
+				Name:        statuses[0].Name,
+				LoadState:   statuses[0].LoadState,
+				ActiveState: statuses[0].ActiveState,
+				SubState:    statuses[0].SubState,
+			}
 		}
 	}
 
 	return
 }
 
-func (c *dbusConnection) SupervisorStatus() (*dbus.UnitStatus, error) {
-	name := pathLib.Base(SUPERVISOR_PATH)
-	return c.UnitStatus(name)
-}
+func (c *dbusConnection) EnableUnits(paths []string) error {
+	_, _, err := c.EnableUnitFiles(paths, false, false)
 
-func (c *dbusConnection) SupervisorRunning() (ret bool, err error) {
-	if status, err := c.SupervisorStatus(); err != nil {
-		return false, err
-	} else {
-		running := status != nil &&
-			status.LoadState == "loaded" &&
-			status.ActiveState == "active"
+	return err
+}
 
-		return running, nil
+func (c *dbusConnection) DisableUnits(paths []string) error {
+	names := make([]string, len(paths))
+	for i, path := range paths {
+		names[i] = pathLib.Base(path)
 	}
-}
 
-func (c *dbusConnection) EnableUnitsAsync(paths []string) error {
-	_, _, err := c.EnableUnitFiles(paths, false, false)
+	_, err := c.DisableUnitFiles(names, false)
 
 	return err
 }
 
-func (c *dbusConnection) EnableStartUnit(path string) error {
-	name := pathLib.Base(path)
-	ch := make(chan string)
-
-	if err := c.EnableUnitsAsync([]string{path}); err != nil {
-		return err
-	} else if _, err := c.StartUnit(name, "replace", ch); err != nil {
-		return err
-	}
-
-	// Block until attempt to start unit succeeds/fails.
+// Waits for the result of a job started on a unit.
+func waitJob(ch <-chan string, action string) error {
 	if result := <-ch; result != "done" {
-		return fmt.Errorf("Start failed due to %s.", result)
+		return fmt.Errorf("%s failed due to %s.", action, result)
 	}
 
 	return nil
 }
 
-func (c *dbusConnection) RestartUnitNoWait(path string) error {
+func (c *dbusConnection) StartUnit(path string) error {
 	name := pathLib.Base(path)
-	_, err := c.RestartUnit(name, "replace", nil)
-
-	return err
-}
+	ch := make(chan string)
 
-func (c *dbusConnection) EnableResinServices() error {
-	if services, err := util.ReadLines(RESIN_SERVICES_PATH); err != nil {
+	if _, err := c.Conn.StartUnit(name, "replace", ch); err != nil {
 		return err
-	} else {
-		paths := make([]string, len(services))
-
-		for i, service := range services {
-			paths[i] = fmt.Sprintf("%s%s", SERVICES_ROOT_PATH, service)
-		}
-
-		return c.EnableUnitsAsync(paths)
 	}
+
+	// Block until attempt to start unit succeeds/fails.
+	return waitJob(ch, "Start")
 }
 
-func (c *dbusConnection) SupervisorEnableStart() error {
-	// Start by enabling the mount overlay service
-	if err := c.EnableStartUnit(MOUNT_OVERLAY_PATH); err != nil {
-		return err
-	}
+func (c *dbusConnection) StopUnit(path string) error {
+	name := pathLib.Base(path)
+	ch := make(chan string)
 
-	// Enabling all required services.
-	if err := c.EnableResinServices(); err != nil {
+	if _, err := c.Conn.StopUnit(name, "replace", ch); err != nil {
 		return err
 	}
 
-	// We need to restart the prepare-openvpn.service ('wanted' by
-	// openvpn-resin.service) to avoid a bug whereby config.json is read
-	// before endpoints are populated, resulting in misconfigured openvpn.
-	if err := c.RestartUnitNoWait(OPENVPN_PATH); err != nil {
-		return err
-	}
+	// Block until attempt to stop unit succeeds/fails.
+	return waitJob(ch, "Stop")
+}
+
+func (c *dbusConnection) RestartUnit(path string) error {
+	name := pathLib.Base(path)
+	_, err := c.Conn.RestartUnit(name, "replace", nil)
 
-	// Start the resin update timer too.
-	return c.EnableStartUnit(UPDATE_RESIN_TIMER_PATH)
+	return err
 }
@@ -0,0 +1,117 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	pathLib "path"
+	"time"
+)
+
+// Returns whether a and b describe the same version of a file.
+func sameVersion(a, b os.FileInfo) bool {
+	return a != nil && b != nil && a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
+
+// Polls dir for a provisioning bundle named BUNDLE_FILE_NAME, e.g. dropped on
+// the boot partition, and provisions the device from it. A bundle is only read
+// once it is unchanged across two polls, so one still being copied isn't
+// mistaken for a broken one. Processed bundles are renamed with a .done or
+// .failed suffix, failures being accompanied by a .error file describing what
+// went wrong. Returns once Shutdown is called.
+func (a *Api) WatchBundles(dir string, interval time.Duration) {
+	watch := &bundleWatch{path: pathLib.Join(dir, BUNDLE_FILE_NAME)}
+
+	for {
+		a.pollBundle(watch)
+
+		select {
+		case <-a.stopping:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+type bundleWatch struct {
+	path string
+	// The bundle as of the last poll, and the version we've dealt with if
+	// it couldn't be moved aside, so that it isn't processed again.
+	last, handled os.FileInfo
+}
+
+func (a *Api) pollBundle(w *bundleWatch) {
+	if info, err := os.Stat(w.path); err == nil {
+		if sameVersion(info, w.last) && !sameVersion(info, w.handled) && a.processBundle(w.path) {
+			w.handled = info
+		}
+		w.last = info
+	} else if os.IsNotExist(err) {
+		w.last, w.handled = nil, nil
+	} else {
+		log.Printf("ERROR: Can't check for bundle %s: %s\n", w.path, err)
+	}
+}
+
+// Provisions from the bundle at path, returning false if it should be retried
+// on the next poll.
+func (a *Api) processBundle(path string) bool {
+	if state, err := a.State(); err != nil {
+		log.Printf("ERROR: Can't check state for bundle %s: %s\n", path, err)
+		return false
+	} else if state == Unknown || state == Provisioned {
+		// A provision interrupted by shutdown is resumed, otherwise we
+		// only provision unprovisioned devices.
+		log.Printf("Device is %s, ignoring bundle %s.\n", state, path)
+		return true
+	}
+
+	log.Printf("Found provisioning bundle %s.\n", path)
+
+	err := a.runCritical(func() error { return a.provisionFromFile(path) })
+	if errorCode(err) == ErrorUnavailable || errors.Is(err, context.Canceled) {
+		// Interrupted by shutdown, leave the bundle to resume from when
+		// we next start.
+		log.Printf("Provisioning from %s interrupted: %s\n", path, err)
+		return false
+	} else if errors.Is(err, errLocked) {
+		// Someone else is provisioning, see where that leaves us next
+		// time.
+		log.Printf("Provisioning from %s postponed: %s\n", path, err)
+		return false
+	} else if err != nil {
+		log.Printf("ERROR: Provisioning from %s failed: %s\n", path, err)
+
+		// The details, which may include credentials, are only logged.
+		e := eventError(err)
+		report := fmt.Sprintf("%s: %s (%s)\n", time.Now().Format(time.RFC3339), e.Message, e.Code)
+		if err := ioutil.WriteFile(path+".error", []byte(report), 0600); err != nil {
+			log.Printf("ERROR: Can't write error report: %s\n", err)
+		}
+		if err := os.Rename(path, path+".failed"); err != nil {
+			log.Printf("ERROR: Can't rename %s: %s\n", path, err)
+		}
+
+		return true
+	}
+
+	log.Printf("Provisioned from %s.\n", path)
+	if err := os.Rename(path, path+".done"); err != nil {
+		log.Printf("ERROR: Can't rename %s: %s\n", path, err)
+	}
+
+	return true
+}
+
+func (a *Api) provisionFromFile(path string) error {
+	if bytes, err := ioutil.ReadFile(path); err != nil {
+		return err
+	} else if bundle, err := ParseBundle(string(bytes)); err != nil {
+		return err
+	} else {
+		return a.ProvisionBundle(bundle)
+	}
+}
@@ -0,0 +1,161 @@
+package provisioner
+
+import (
+	"io/ioutil"
+	"os"
+	pathLib "path"
+	"testing"
+)
+
+// Returns the contents of a bundle provisioning with opts.
+func testBundle(t *testing.T, opts *ProvisionOpts) string {
+	bundle := &Bundle{
+		ApplicationId: opts.ApplicationId,
+		ApiKey:        opts.ApiKey,
+		UserId:        opts.UserId,
+		UserName:      opts.UserName,
+		ApiEndpoint:   opts.ApiEndpoint,
+	}
+	str, err := bundle.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return str
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestProcessBundle(t *testing.T) {
+	defer withResinServices(t, "resin-supervisor.service\n")()
+	server, opts := newTestServer(t)
+	defer server.Close()
+	api, cleanup := newTestApi(t)
+	defer cleanup()
+	path := pathLib.Join(pathLib.Dir(api.ConfigPath), BUNDLE_FILE_NAME)
+
+	// A broken bundle is moved aside with a report.
+	if err := ioutil.WriteFile(path, []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if !api.processBundle(path) {
+		t.Error("Broken bundle not handled")
+	} else if exists(path) || !exists(path+".failed") {
+		t.Error("Broken bundle not renamed .failed")
+	} else if report, err := ioutil.ReadFile(path + ".error"); err != nil || len(report) == 0 {
+		t.Errorf("No error report for broken bundle: %v", err)
+	} else if info, err := os.Stat(path + ".error"); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Error report readable by others: %v", err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(testBundle(t, opts)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if !api.processBundle(path) {
+		t.Error("Bundle not handled")
+	} else if exists(path) || !exists(path+".done") {
+		t.Error("Bundle not renamed .done")
+	} else if state, _ := api.State(); state != Provisioned {
+		t.Errorf("Unexpected state %s after bundle", state)
+	}
+
+	// Once provisioned, further bundles are left alone.
+	if err := ioutil.WriteFile(path, []byte(testBundle(t, opts)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(path + ".error")
+	if !api.processBundle(path) {
+		t.Error("Bundle for provisioned device not handled")
+	} else if !exists(path) || exists(path+".error") {
+		t.Error("Bundle for provisioned device not left alone")
+	} else if n := server.DeviceCount(); n != 1 {
+		t.Errorf("Expected 1 registered device, got %d", n)
+	}
+}
+
+func TestPollBundleWaitsForCompleteBundle(t *testing.T) {
+	defer withResinServices(t, "resin-supervisor.service\n")()
+	server, opts := newTestServer(t)
+	defer server.Close()
+	api, cleanup := newTestApi(t)
+	defer cleanup()
+	watch := &bundleWatch{path: pathLib.Join(pathLib.Dir(api.ConfigPath), BUNDLE_FILE_NAME)}
+
+	// Still being copied.
+	content := testBundle(t, opts)
+	if err := ioutil.WriteFile(watch.path, []byte(content[:10]), 0600); err != nil {
+		t.Fatal(err)
+	}
+	api.pollBundle(watch)
+	if err := ioutil.WriteFile(watch.path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	api.pollBundle(watch)
+	if !exists(watch.path) {
+		t.Fatal("Bundle processed before it stopped changing")
+	}
+
+	api.pollBundle(watch)
+	if exists(watch.path) || !exists(watch.path+".done") {
+		t.Error("Complete bundle not processed")
+	}
+}
+
+func TestPollBundleHandlesOnce(t *testing.T) {
+	api, cleanup := newTestApi(t)
+	defer cleanup()
+	watch := &bundleWatch{path: pathLib.Join(pathLib.Dir(api.ConfigPath), BUNDLE_FILE_NAME)}
+
+	if err := ioutil.WriteFile(watch.path, []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Stop the bundle being renamed, as on a read-only partition.
+	if err := os.MkdirAll(pathLib.Join(watch.path+".failed", "x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	api.pollBundle(watch)
+	api.pollBundle(watch)
+	if !exists(watch.path + ".error") {
+		t.Fatal("Broken bundle not reported")
+	}
+
+	os.Remove(watch.path + ".error")
+	api.pollBundle(watch)
+	if exists(watch.path + ".error") {
+		t.Error("Broken bundle reported again")
+	}
+}
+
+func TestProcessBundleWhileLocked(t *testing.T) {
+	requireFileLock(t)
+	defer withResinServices(t, "resin-supervisor.service\n")()
+	server, opts := newTestServer(t)
+	defer server.Close()
+	api, cleanup := newTestApi(t)
+	defer cleanup()
+	path := pathLib.Join(pathLib.Dir(api.ConfigPath), BUNDLE_FILE_NAME)
+	if err := ioutil.WriteFile(path, []byte(testBundle(t, opts)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another process, e.g. the CLI, is provisioning.
+	other := New(api.ConfigPath)
+	if err := other.withLock(func() error {
+		if api.processBundle(path) {
+			t.Error("Bundle handled while locked")
+		} else if !exists(path) || exists(path+".failed") {
+			t.Error("Bundle moved while locked")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !api.processBundle(path) || !exists(path+".done") {
+		t.Error("Bundle not processed once unlocked")
+	}
+}
@@ -0,0 +1,173 @@
+package resin
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultTimeout   = 30 * time.Second
+	DefaultUserAgent = "resin-provisioner"
+)
+
+// A client for the Resin API at Endpoint. User-scoped requests are
+// authenticated with Token, device requests with ApiKey.
+type Client struct {
+	Endpoint   string
+	Token      string
+	ApiKey     string
+	HTTPClient *http.Client
+	UserAgent  string
+	Retry      RetryPolicy
+}
+
+func NewClient(endpoint string) *Client {
+	return &Client{
+		Endpoint:   endpoint,
+		HTTPClient: &http.Client{Timeout: DefaultTimeout},
+		UserAgent:  DefaultUserAgent,
+		Retry:      DefaultRetryPolicy,
+	}
+}
+
+// Returns a copy of the client authenticating with a user token.
+func (c *Client) WithToken(token string) *Client {
+	ret := *c
+	ret.Token = token
+	return &ret
+}
+
+// Returns a copy of the client authenticating with an application API key.
+func (c *Client) WithApiKey(apiKey string) *Client {
+	ret := *c
+	ret.ApiKey = apiKey
+	return &ret
+}
+
+// Returns a copy of the client without credentials, for public endpoints.
+func (c *Client) anonymous() *Client {
+	ret := *c
+	ret.Token = ""
+	ret.ApiKey = ""
+	return &ret
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+
+	return c.HTTPClient
+}
+
+// Performs a single request against the API, returning the response. The
+// token is used for authentication if set, otherwise the API key.
+func (c *Client) do(ctx context.Context, method, path string, body []byte) ([]byte, *http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequest(method, c.Endpoint+path, reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	req = req.WithContext(ctx)
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	} else if c.ApiKey != "" {
+		query := req.URL.Query()
+		query.Set("apikey", c.ApiKey)
+		req.URL.RawQuery = query.Encode()
+	}
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, nil, withoutQuery(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return b, resp, nil
+}
+
+// Performs a request, retrying transient failures according to c.Retry, and
+// returns the body of a successful response. Failures are returned as an
+// *ApiError unless the context was cancelled.
+func (c *Client) request(ctx context.Context, method, path string, body []byte,
+	idempotent bool) ([]byte, error) {
+	attempts := c.Retry.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	for attempt := 1; ; attempt++ {
+		var apiErr *ApiError
+		var header http.Header
+
+		b, resp, err := c.do(ctx, method, path, body)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		} else if err != nil {
+			apiErr = &ApiError{Method: method, Path: path, Kind: ErrTransient, Err: err}
+		} else if isHttpSuccess(resp.StatusCode) {
+			return b, nil
+		} else {
+			header = resp.Header
+			apiErr = &ApiError{Method: method, Path: path, Status: resp.StatusCode,
+				Body: string(b), Kind: classifyStatus(resp.StatusCode)}
+		}
+
+		// Only retry where we know the request wasn't processed, or it
+		// doesn't matter if it was.
+		retry := apiErr.Kind == ErrTransient &&
+			(idempotent || apiErr.Status == http.StatusTooManyRequests)
+		if !retry || attempt >= attempts {
+			return nil, apiErr
+		}
+
+		delay := c.Retry.delay(attempt, header)
+		log.Printf("%s, retrying in %s", apiErr, delay)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Returns err with the query removed from the URL it refers to, as it may
+// contain the API key.
+func withoutQuery(err error) error {
+	urlErr, ok := err.(*url.Error)
+	if !ok {
+		return err
+	}
+
+	ret := *urlErr
+	if i := strings.IndexByte(ret.URL, '?'); i >= 0 {
+		ret.URL = ret.URL[:i]
+	}
+	return &ret
+}
+
+func isHttpSuccess(status int) bool {
+	return status/100 == 2
+}
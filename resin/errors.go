@@ -0,0 +1,62 @@
+package resin
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Classes of failure from the Resin API, check for these with errors.Is.
+var (
+	ErrUnauthorized = errors.New("Unauthorized")
+	ErrNotFound     = errors.New("Not found")
+	ErrConflict     = errors.New("Conflict")
+	// The request may succeed if retried later, e.g. network errors and
+	// 5xx responses.
+	ErrTransient = errors.New("Temporary failure")
+)
+
+// A failed request to the Resin API.
+type ApiError struct {
+	Method string
+	Path   string
+	// Zero if no response was received.
+	Status int
+	Body   string
+	// One of the Err* classes above, or nil if unclassified.
+	Kind error
+	// The underlying error if no response was received.
+	Err error
+}
+
+// The message never includes the API key, so is safe to log.
+func (e *ApiError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s %s failed: %s", e.Method, e.Path, withoutQuery(e.Err))
+	}
+
+	return fmt.Sprintf("%s %s returned %d: %s", e.Method, e.Path, e.Status, e.Body)
+}
+
+func (e *ApiError) Is(target error) bool {
+	return e.Kind != nil && target == e.Kind
+}
+
+func (e *ApiError) Unwrap() error {
+	return e.Err
+}
+
+func classifyStatus(status int) error {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return ErrUnauthorized
+	case status == http.StatusNotFound:
+		return ErrNotFound
+	case status == http.StatusConflict:
+		return ErrConflict
+	case status == http.StatusTooManyRequests || status/100 == 5:
+		return ErrTransient
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package resin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Minimal helpers for the pine (OData) resources under /v1.
+
+// Quotes a string for use in a $filter expression.
+func pineQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// Returns the id referred to by a field, which may be a plain value, a
+// deferred reference ({"__id": ...}) or an expanded object ({"id": ...}).
+func pineId(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, v != ""
+	case float64:
+		return strconv.FormatInt(int64(v), 10), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case map[string]interface{}:
+		if id, ok := v["__id"]; ok {
+			return pineId(id)
+		}
+		return pineId(v["id"])
+	case []interface{}:
+		// Expanded navigation properties come back as a single
+		// element array.
+		if len(v) == 1 {
+			return pineId(v[0])
+		}
+	}
+
+	return "", false
+}
+
+func (c *Client) pineList(ctx context.Context, resource, filter string) ([]map[string]interface{}, error) {
+	path := "/v1/" + resource
+	if filter != "" {
+		path += "?" + url.Values{"$filter": {filter}}.Encode()
+	}
+
+	var ret struct {
+		D []map[string]interface{} `json:"d"`
+	}
+	if body, err := c.request(ctx, "GET", path, nil, true); err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(body, &ret); err != nil {
+		return nil, err
+	}
+
+	return ret.D, nil
+}
+
+// Creates an instance of resource, returning the created object. Only retried
+// on failure if idempotent, e.g. due to a unique field.
+func (c *Client) pineCreate(ctx context.Context, resource string, fields map[string]interface{},
+	idempotent bool) (map[string]interface{}, error) {
+	var ret map[string]interface{}
+
+	if b, err := json.Marshal(fields); err != nil {
+		return nil, err
+	} else if body, err := c.request(ctx, "POST", "/v1/"+resource, b, idempotent); err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(body, &ret); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+func (c *Client) pinePatch(ctx context.Context, resource string, id int64, fields map[string]interface{}) error {
+	path := fmt.Sprintf("/v1/%s(%d)", resource, id)
+
+	if b, err := json.Marshal(fields); err != nil {
+		return err
+	} else if _, err := c.request(ctx, "PATCH", path, b, true); err != nil {
+		return err
+	}
+
+	return nil
+}
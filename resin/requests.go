@@ -1,124 +1,73 @@
 package resin
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
-	"net/http"
 	"strconv"
 	"strings"
 
-	pinejs "github.com/resin-io/pinejs-client-go"
 	"github.com/resin-os/resin-provisioner/util"
 )
 
-// Simple http GET request helper
-func getUrl(url string) ([]byte, int, error) {
-	resp, err := http.Get(url)
-	if err != nil {
-		return nil, 0, err
-	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, 0, err
-	}
-	return body, resp.StatusCode, nil
-}
-
-// Simple http POST helper
-func postUrl(url string, bodyType string, body []byte) ([]byte, int, error) {
-	resp, err := http.Post(url, bodyType, bytes.NewBuffer(body))
-	if err != nil {
-		return nil, 0, err
-	}
-	defer resp.Body.Close()
-	b, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, 0, err
-	}
-	return b, resp.StatusCode, nil
-}
-
-// Simple http POST helper with an auth token
-func postWithToken(url, token, bodyType string, body []byte) ([]byte, int, error) {
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
-	if err != nil {
-		return nil, 0, err
-	}
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Content-Type", bodyType)
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, 0, err
-	}
-	defer resp.Body.Close()
-	b, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, 0, err
-	}
-	return b, resp.StatusCode, nil
-}
-
-func isHttpSuccess(status int) bool {
-	return status/100 == 2
-}
-
-func pineQueryEscape(s string) string {
-	return strings.Replace(s, " ", "%20", -1)
-}
-func authPost(endpoint, path string, b map[string]string) (token string, err error) {
+func (c *Client) authPost(ctx context.Context, path string, b map[string]string) (token string, err error) {
 	body, err := json.Marshal(b)
 	if err != nil {
 		return "", err
 	}
-	if resp, status, err := postUrl(endpoint+path, "application/json", body); err != nil {
+	if resp, err := c.request(ctx, "POST", path, body, false); err != nil {
 		return "", err
-	} else if !isHttpSuccess(status) {
-		log.Printf("POST to %s returned %d: %s", path, status, resp)
-		return "", nil
 	} else {
 		return string(resp), nil
 	}
 }
 
-func Login(endpoint, email, password string) (token string, err error) {
+// Returns a user token, failing with ErrUnauthorized if the credentials are
+// wrong.
+func (c *Client) Login(ctx context.Context, email, password string) (token string, err error) {
 	b := map[string]string{"username": email, "password": password}
-	return authPost(endpoint, "/login_", b)
+	return c.authPost(ctx, "/login_", b)
 }
 
-func Signup(endpoint, email, password string) (token string, err error) {
+func (c *Client) Signup(ctx context.Context, email, password string) (token string, err error) {
 	b := map[string]string{"email": email, "password": password}
-	return authPost(endpoint, "/user/register", b)
+	return c.authPost(ctx, "/user/register", b)
 }
 
-func GetApps(endpoint, token string) (apps []map[string]interface{}, err error) {
-	var deviceType string
-	client := pinejs.NewClientWithToken(endpoint+"/v1", token)
-	apps = []map[string]interface{}{map[string]interface{}{"pinejs": "application"}}
-	if deviceType, err = util.ScanDeviceTypeSlug(util.OSRELEASE_PATH); err != nil {
+// Returns the applications matching this device's type.
+func (c *Client) GetApps(ctx context.Context) ([]map[string]interface{}, error) {
+	if deviceType, err := util.ScanDeviceTypeSlug(util.OSRELEASE_PATH); err != nil {
 		return nil, fmt.Errorf("Could not get device type: %s", err)
+	} else {
+		return c.pineList(ctx, "application", "device_type eq "+pineQuote(deviceType))
 	}
-	deviceTypeFilter := fmt.Sprintf("device_type eq '%s'", deviceType)
-	err = client.List(&apps, pinejs.NewQueryOptions(pinejs.Filter, deviceTypeFilter)...)
-	return
 }
 
-func CreateApp(endpoint, name, token string) (id string, err error) {
-	client := pinejs.NewClientWithToken(endpoint+"/v1", token)
+// Looks up an application by name regardless of device type, for use off
+// the device.
+func (c *Client) GetAppByName(ctx context.Context, name string) (id string, err error) {
+	if apps, err := c.pineList(ctx, "application", "app_name eq "+pineQuote(name)); err != nil {
+		return "", err
+	} else if len(apps) == 0 {
+		return "", errors.New("Application not found")
+	} else if appId, ok := apps[0]["id"].(float64); !ok {
+		return "", errors.New("Invalid app id from API")
+	} else {
+		return strconv.Itoa(int(appId)), nil
+	}
+}
+
+func (c *Client) CreateApp(ctx context.Context, name string) (id string, err error) {
 	app := make(map[string]interface{})
-	app["pinejs"] = "application"
 	app["app_name"] = name
 	t, e := util.ScanDeviceTypeSlug(util.OSRELEASE_PATH)
 	if e != nil {
 		return "", fmt.Errorf("Could not get device type: %s", e)
 	}
 	app["device_type"] = t
-	if err := client.Create(&app); err != nil {
-		return "", fmt.Errorf("Could not create application: %s", err)
+	if app, err = c.pineCreate(ctx, "application", app, false); err != nil {
+		return "", fmt.Errorf("Could not create application: %w", err)
 	}
 	appId, ok := app["id"].(float64)
 	if !ok {
@@ -127,50 +76,157 @@ func CreateApp(endpoint, name, token string) (id string, err error) {
 	return strconv.Itoa(int(appId)), nil
 }
 
-func GetApiKey(endpoint, appId, token string) (apiKey string, err error) {
-	resp, status, err := postWithToken(endpoint+"/application/"+appId+"/generate-api-key", token, "application/json", []byte("{}"))
+func (c *Client) GetApiKey(ctx context.Context, appId string) (apiKey string, err error) {
+	// Each call generates a new key, so this isn't idempotent.
+	resp, err := c.request(ctx, "POST", "/application/"+appId+"/generate-api-key", []byte("{}"), false)
 	if err != nil {
 		return "", err
-	} else if !isHttpSuccess(status) {
-		return "", fmt.Errorf("Error getting apikey: %d %s", status, resp)
 	} else {
 		return strings.Trim(string(resp), `"`), nil
 	}
 }
 
-func CreateOrGetDevice(endpoint string, device *map[string]interface{}, apikey string) error {
-	client := pinejs.NewClient(endpoint+"/v1", apikey)
-	(*device)["pinejs"] = "device"
-	if err := client.Create(device); err != nil {
-		if strings.Contains(err.Error(), `"uuid" must be unique`) || strings.Contains(err.Error(), `Data is referenced by uuid`) {
-			uuid, ok := (*device)["uuid"].(string)
-			if !ok {
-				return errors.New("Invalid uuid")
-			}
-			devices := []map[string]interface{}{map[string]interface{}{"pinejs": "device"}}
-			if err := client.List(&devices, pinejs.NewQueryOptions(pinejs.Filter, "uuid eq '"+uuid+"'")...); err != nil {
-				return err
-			} else if len(devices) != 1 {
-				return errors.New("Invalid object returned from API")
-			} else {
-				*device = devices[0]
-			}
-		} else {
+// Registers the device, or if a device with the same uuid is already
+// registered to the same application and user replaces the contents of device
+// with it. A uuid belonging to anyone else's device results in an error
+// matching ErrConflict.
+func (c *Client) CreateOrGetDevice(ctx context.Context, device *map[string]interface{}) error {
+	uuid, ok := (*device)["uuid"].(string)
+	if !ok || uuid == "" {
+		return errors.New("Invalid uuid")
+	}
+
+	if existing, err := c.getDeviceByUuid(ctx, uuid); err != nil {
+		return err
+	} else if existing != nil {
+		return adoptDevice(device, existing)
+	}
+
+	// The uuid is unique so retrying can't create a duplicate.
+	created, err := c.pineCreate(ctx, "device", *device, true)
+	if errors.Is(err, ErrConflict) {
+		// Most likely we raced with another registration, or a retry
+		// of our own succeeded, so look again.
+		if existing, err := c.getDeviceByUuid(ctx, uuid); err != nil {
 			return err
+		} else if existing == nil {
+			return fmt.Errorf("Device uuid %s is already in use by a device we can't access: %w",
+				uuid, ErrConflict)
+		} else {
+			return adoptDevice(device, existing)
 		}
+	} else if err != nil {
+		return err
 	}
+
+	*device = created
 	return nil
 }
 
-func GetConfig(endpoint string) (map[string]interface{}, error) {
+// Returns the device with the specified uuid, or nil if there is none visible
+// to us.
+func (c *Client) getDeviceByUuid(ctx context.Context, uuid string) (map[string]interface{}, error) {
+	if devices, err := c.pineList(ctx, "device", "uuid eq "+pineQuote(uuid)); err != nil {
+		return nil, err
+	} else if len(devices) == 0 {
+		return nil, nil
+	} else if len(devices) > 1 {
+		return nil, errors.New("Invalid object returned from API")
+	} else {
+		return devices[0], nil
+	}
+}
+
+// Replaces device with an existing device after checking the existing one
+// belongs to the same application and user.
+func adoptDevice(device *map[string]interface{}, existing map[string]interface{}) error {
+	uuid, _ := (*device)["uuid"].(string)
+
+	for _, field := range []string{"application", "user"} {
+		want, wantOk := pineId((*device)[field])
+		got, gotOk := pineId(existing[field])
+		if !wantOk {
+			return fmt.Errorf("Invalid %s for device", field)
+		} else if !gotOk || want != got {
+			return fmt.Errorf("Device uuid %s is already in use by another %s's device: %w",
+				uuid, field, ErrConflict)
+		}
+	}
+
+	*device = existing
+	return nil
+}
+
+func (c *Client) GetDeviceId(ctx context.Context, uuid string) (int64, error) {
+	if device, err := c.getDeviceByUuid(ctx, uuid); err != nil {
+		return 0, err
+	} else if device == nil {
+		return 0, fmt.Errorf("Device %s not found: %w", uuid, ErrNotFound)
+	} else if id, ok := device["id"].(float64); !ok || id == 0 {
+		return 0, errors.New("Invalid device id from API")
+	} else {
+		return int64(id), nil
+	}
+}
+
+func (c *Client) MoveDevice(ctx context.Context, deviceId int64, appId string) error {
+	device := map[string]interface{}{"application": appId}
+	if err := c.pinePatch(ctx, "device", deviceId, device); err != nil {
+		return fmt.Errorf("Could not move device: %w", err)
+	}
+	return nil
+}
+
+func (c *Client) GetConfig(ctx context.Context) (map[string]interface{}, error) {
 	conf := make(map[string]interface{})
-	if r, status, err := getUrl(endpoint + "/config"); err != nil {
+	// This is public, so don't hand out our credentials.
+	if r, err := c.anonymous().request(ctx, "GET", "/config", nil, true); err != nil {
 		return nil, err
-	} else if !isHttpSuccess(status) {
-		return nil, fmt.Errorf("Error status from Resin API: %d", status)
 	} else if err = json.Unmarshal(r, &conf); err != nil {
 		return nil, err
 	} else {
 		return conf, nil
 	}
 }
+
+// Package-level helpers for one-off requests with a default client.
+
+func Login(endpoint, email, password string) (token string, err error) {
+	return NewClient(endpoint).Login(context.Background(), email, password)
+}
+
+func Signup(endpoint, email, password string) (token string, err error) {
+	return NewClient(endpoint).Signup(context.Background(), email, password)
+}
+
+func GetApps(endpoint, token string) (apps []map[string]interface{}, err error) {
+	return NewClient(endpoint).WithToken(token).GetApps(context.Background())
+}
+
+func GetAppByName(endpoint, token, name string) (id string, err error) {
+	return NewClient(endpoint).WithToken(token).GetAppByName(context.Background(), name)
+}
+
+func CreateApp(endpoint, name, token string) (id string, err error) {
+	return NewClient(endpoint).WithToken(token).CreateApp(context.Background(), name)
+}
+
+func GetApiKey(endpoint, appId, token string) (apiKey string, err error) {
+	return NewClient(endpoint).WithToken(token).GetApiKey(context.Background(), appId)
+}
+
+func CreateOrGetDevice(endpoint string, device *map[string]interface{}, apikey string) error {
+	return NewClient(endpoint).WithApiKey(apikey).CreateOrGetDevice(context.Background(), device)
+}
+
+func GetDeviceId(endpoint, token, uuid string) (int64, error) {
+	return NewClient(endpoint).WithToken(token).GetDeviceId(context.Background(), uuid)
+}
+
+func MoveDevice(endpoint, token string, deviceId int64, appId string) error {
+	return NewClient(endpoint).WithToken(token).MoveDevice(context.Background(), deviceId, appId)
+}
+
+func GetConfig(endpoint string) (map[string]interface{}, error) {
+	return NewClient(endpoint).GetConfig(context.Background())
+}
@@ -1,36 +1,163 @@
 package resin
 
 import (
-	"os"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
 	"testing"
+
+	"github.com/resin-os/resin-provisioner/resin/resintest"
 )
 
 func TestAuth(t *testing.T) {
-	e := os.Getenv("RESIN_EMAIL")
-	p := os.Getenv("RESIN_PASSWORD")
+	server := resintest.NewServer()
+	defer server.Close()
+	e, p := "user@example.com", "password"
 
-	if e == "" || p == "" {
-		t.Skip("Skipping integration test, env vars not defined")
+	token, err := Signup(server.URL, e, p)
+	if err != nil {
+		t.Errorf("Error signing up: %s", err)
+	} else if token == "" {
+		t.Error("Empty token after signup")
+	} else if id1, err := GetUserId(token); err != nil {
+		t.Error("Invalid token after signup")
 	} else {
-		token, err := Signup("https://api.resinstaging.io", e, p)
+		token2, err := Login(server.URL, e, p)
 		if err != nil {
-			t.Errorf("Error signing up: %s", err)
-		} else if token == "" {
-			t.Error("Empty token after signup")
-		} else if id1, err := GetUserId(token); err != nil {
-			t.Error("Invalid token after signup")
-		} else {
-			token2, err := Login("https://api.resinstaging.io", e, p)
-			if err != nil {
-				t.Errorf("Error logging in: %s", err)
-			} else if token == "" {
-				t.Error("Empty token after login")
-			} else if id2, err := GetUserId(token2); err != nil {
-				t.Error("Invalid token after login")
-			} else if id1 != id2 {
-				t.Error("User ids don't match on login and signup")
-			}
+			t.Errorf("Error logging in: %s", err)
+		} else if token2 == "" {
+			t.Error("Empty token after login")
+		} else if id2, err := GetUserId(token2); err != nil {
+			t.Error("Invalid token after login")
+		} else if id1 != id2 {
+			t.Error("User ids don't match on login and signup")
+		}
+	}
+
+	if _, err := Login(server.URL, e, "wrong"); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Expected unauthorized logging in with the wrong password, got %v", err)
+	}
+}
+
+func TestAdoptDevice(t *testing.T) {
+	device := map[string]interface{}{"uuid": "abc", "application": "1", "user": "2"}
+
+	other := map[string]interface{}{
+		"uuid":        "abc",
+		"application": map[string]interface{}{"__deferred": map[string]interface{}{}, "__id": float64(3)},
+		"user":        float64(2),
+	}
+	if err := adoptDevice(&device, other); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected conflict adopting another application's device, got %v", err)
+	} else if device["application"] != "1" {
+		t.Error("Device replaced despite conflict")
+	}
+
+	ours := map[string]interface{}{
+		"id":          float64(10),
+		"uuid":        "abc",
+		"application": map[string]interface{}{"__deferred": map[string]interface{}{}, "__id": float64(1)},
+		"user":        map[string]interface{}{"__deferred": map[string]interface{}{}, "__id": float64(2)},
+	}
+	if err := adoptDevice(&device, ours); err != nil {
+		t.Errorf("Error adopting our own device: %s", err)
+	} else if device["id"] != float64(10) {
+		t.Error("Device not replaced with existing device")
+	}
+}
+
+func TestCreateOrGetDevice(t *testing.T) {
+	server := resintest.NewServer()
+	defer server.Close()
+
+	userId, _ := server.AddUser("user@example.com", "password")
+	appId := server.AddApplication(userId, "test", "raspberrypi3")
+	otherUserId, _ := server.AddUser("other@example.com", "password")
+	server.AddDevice(otherUserId, server.AddApplication(otherUserId, "other", "raspberrypi3"), "taken")
+
+	client := NewClient(server.URL).WithApiKey(server.AddApiKey(appId))
+	newDevice := func(uuid string) map[string]interface{} {
+		return map[string]interface{}{
+			"uuid":        uuid,
+			"user":        strconv.FormatInt(userId, 10),
+			"application": strconv.FormatInt(appId, 10),
 		}
 	}
 
+	first := newDevice("abc")
+	second := newDevice("abc")
+	if err := client.CreateOrGetDevice(context.Background(), &first); err != nil {
+		t.Fatalf("Error creating device: %s", err)
+	} else if err := client.CreateOrGetDevice(context.Background(), &second); err != nil {
+		t.Fatalf("Error getting existing device: %s", err)
+	} else if first["id"] != second["id"] {
+		t.Errorf("Device ids %v and %v don't match for the same uuid", first["id"], second["id"])
+	}
+
+	taken := newDevice("taken")
+	if err := client.CreateOrGetDevice(context.Background(), &taken); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected conflict for another user's uuid, got %v", err)
+	}
+}
+
+func TestMoveDevice(t *testing.T) {
+	server := resintest.NewServer()
+	defer server.Close()
+
+	userId, token := server.AddUser("user@example.com", "password")
+	appId := server.AddApplication(userId, "test", "raspberrypi3")
+	newAppId := server.AddApplication(userId, "new", "raspberrypi3")
+	otherUserId, _ := server.AddUser("other@example.com", "password")
+	otherAppId := server.AddApplication(otherUserId, "other", "raspberrypi3")
+	deviceId := server.AddDevice(userId, appId, "abc")
+
+	if err := MoveDevice(server.URL, token, deviceId, strconv.FormatInt(otherAppId, 10)); err == nil {
+		t.Error("Moved device to another user's application")
+	}
+
+	if err := MoveDevice(server.URL, token, deviceId, strconv.FormatInt(newAppId, 10)); err != nil {
+		t.Fatalf("Error moving device: %s", err)
+	} else if id, ok := pineId(server.Device("abc")["application"]); !ok || id != strconv.FormatInt(newAppId, 10) {
+		t.Errorf("Device application %v not updated", id)
+	}
+}
+
+func TestApiKeyNotLeaked(t *testing.T) {
+	var query url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		w.Write([]byte(`{"mixpanelToken": "abc"}`))
+	}))
+	client := NewClient(server.URL).WithApiKey("secretkey")
+	client.Retry = fastRetry
+
+	if _, err := client.GetConfig(context.Background()); err != nil {
+		t.Errorf("Error getting config: %s", err)
+	} else if query.Get("apikey") != "" {
+		t.Errorf("API key sent to public endpoint: %s", query.Encode())
+	}
+
+	server.Close()
+	_, err := client.pineList(context.Background(), "device", "")
+	var apiErr *ApiError
+	if !errors.As(err, &apiErr) || apiErr.Err == nil {
+		t.Fatalf("Expected transport error, got %v", err)
+	} else if strings.Contains(apiErr.Err.Error(), "secretkey") {
+		t.Errorf("API key in error: %s", apiErr.Err)
+	}
+}
+
+func TestApiErrorRedacted(t *testing.T) {
+	err := &ApiError{Method: "GET", Path: "/v1/device", Kind: ErrTransient,
+		Err: &url.Error{Op: "Get", URL: "http://127.0.0.1:1/v1/device?apikey=secretkey",
+			Err: errors.New("connection refused")}}
+	if msg := err.Error(); strings.Contains(msg, "secretkey") {
+		t.Errorf("API key in error: %s", msg)
+	} else if !strings.Contains(msg, "connection refused") {
+		t.Errorf("Cause missing from error: %s", msg)
+	}
 }
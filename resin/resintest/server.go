@@ -0,0 +1,539 @@
+// Package resintest provides an in-process fake of the parts of the Resin API
+// used by the provisioner, for exercising it in tests without network access.
+package resintest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Values returned from GET /config.
+const (
+	MixpanelToken      = "abcdefghijklmnopqrstuvwxyz123456"
+	PubnubPublishKey   = "pub-c-abc12345-ab1a-12a1-9876-01ab1abcd8zx"
+	PubnubSubscribeKey = "sub-c-abc12345-ab1a-12a1-9876-01ab1abcd8zx"
+)
+
+// A failure injected into requests matching Method and Path. An empty Method
+// matches any method, Path matches as a prefix.
+type Fault struct {
+	Method string
+	Path   string
+	Status int
+	Body   string
+	// Sent as a Retry-After header if non-empty.
+	RetryAfter string
+	// The number of matching requests to fail, every one if 0.
+	Count int
+}
+
+type user struct {
+	id       int64
+	email    string
+	password string
+}
+
+// A fake Resin API. Objects are kept in memory and returned in the same
+// forms as the real API, including deferred references to related objects.
+type Server struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	nextId  int64
+	users   map[string]*user // By email.
+	tokens  map[string]*user
+	apiKeys map[string]int64 // Application id by key.
+	apps    map[int64]map[string]interface{}
+	devices map[int64]map[string]interface{}
+	faults  []*Fault
+	latency time.Duration
+	// Requests received, as "METHOD /path".
+	requests []string
+}
+
+var (
+	keyPathRegexp  = regexp.MustCompile(`^/application/([0-9]+)/generate-api-key$`)
+	pinePathRegexp = regexp.MustCompile(`^/v1/(application|device)(?:\(([0-9]+)\))?$`)
+	// Only simple equality filters, as used by the client.
+	filterRegexp = regexp.MustCompile(`^([a-z_]+) eq (?:'((?:[^']|'')*)'|([0-9]+))$`)
+)
+
+// Starts a fake server, which should be closed with Close.
+func NewServer() *Server {
+	s := &Server{
+		nextId:  1,
+		users:   make(map[string]*user),
+		tokens:  make(map[string]*user),
+		apiKeys: make(map[string]int64),
+		apps:    make(map[int64]map[string]interface{}),
+		devices: make(map[int64]map[string]interface{}),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+
+	return s
+}
+
+// Adds a user, returning their id and a token authenticating as them.
+func (s *Server) AddUser(email, password string) (id int64, token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u := s.addUser(email, password)
+	return u.id, s.newToken(u)
+}
+
+// Adds an application belonging to the user, returning its id.
+func (s *Server) AddApplication(userId int64, name, deviceType string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.addApplication(userId, name, deviceType)
+}
+
+// Generates an API key for the application.
+func (s *Server) AddApiKey(appId int64) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.newApiKey(appId)
+}
+
+// Registers a device directly, as if by another provisioner.
+func (s *Server) AddDevice(userId, appId int64, uuid string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	device := map[string]interface{}{"uuid": uuid, "device_type": "raspberrypi3"}
+	return s.addDevice(userId, appId, device)
+}
+
+// Returns the device with the specified uuid as the API would, or nil.
+func (s *Server) Device(uuid string) map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, device := range s.devices {
+		if device["uuid"] == uuid {
+			return s.render("device", device)
+		}
+	}
+
+	return nil
+}
+
+// Returns the number of registered devices.
+func (s *Server) DeviceCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.devices)
+}
+
+// Returns the requests received so far, as "METHOD /path".
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.requests...)
+}
+
+// Adds a fault, taking precedence over those added before it.
+func (s *Server) Inject(f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.faults = append([]*Fault{&f}, s.faults...)
+}
+
+// Removes all injected faults.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.faults = nil
+}
+
+// Delays every response by d.
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.latency = d
+}
+
+func (s *Server) addUser(email, password string) *user {
+	u := &user{id: s.newId(), email: email, password: password}
+	s.users[email] = u
+	return u
+}
+
+func (s *Server) addApplication(userId int64, name, deviceType string) int64 {
+	id := s.newId()
+	s.apps[id] = map[string]interface{}{
+		"id":          id,
+		"app_name":    name,
+		"device_type": deviceType,
+		"user":        userId,
+	}
+	return id
+}
+
+func (s *Server) addDevice(userId, appId int64, device map[string]interface{}) int64 {
+	id := s.newId()
+	device["id"] = id
+	device["user"] = userId
+	device["application"] = appId
+	s.devices[id] = device
+	return id
+}
+
+func (s *Server) newId() int64 {
+	id := s.nextId
+	s.nextId++
+	return id
+}
+
+// Returns an unsigned JWT carrying the claims the provisioner reads.
+func (s *Server) newToken(u *user) string {
+	username := strings.SplitN(u.email, "@", 2)[0]
+	claims, _ := json.Marshal(map[string]interface{}{
+		"id":       u.id,
+		"username": username,
+		"email":    u.email,
+		"iat":      s.nextId,
+	})
+	s.nextId++
+
+	enc := base64.RawURLEncoding
+	token := enc.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`)) + "." +
+		enc.EncodeToString(claims) + "." + enc.EncodeToString([]byte("signature"))
+	s.tokens[token] = u
+	return token
+}
+
+func (s *Server) newApiKey(appId int64) string {
+	key := fmt.Sprintf("fakeapikey%d", s.newId())
+	s.apiKeys[key] = appId
+	return key
+}
+
+// Returns a copy of obj with references to other objects deferred, as pine
+// returns them.
+func (s *Server) render(resource string, obj map[string]interface{}) map[string]interface{} {
+	ret := make(map[string]interface{})
+	for key, value := range obj {
+		ret[key] = value
+	}
+
+	ret["__metadata"] = map[string]interface{}{
+		"uri": fmt.Sprintf("/resin/%s(%d)", resource, obj["id"]),
+	}
+	for _, ref := range []string{"application", "user"} {
+		if id, ok := obj[ref].(int64); ok {
+			ret[ref] = map[string]interface{}{
+				"__deferred": map[string]interface{}{
+					"uri": fmt.Sprintf("/resin/%s(%d)", ref, id),
+				},
+				"__id": id,
+			}
+		}
+	}
+
+	return ret
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+	latency := s.latency
+	fault := s.matchFault(r)
+	s.mu.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if fault != nil {
+		if fault.RetryAfter != "" {
+			w.Header().Set("Retry-After", fault.RetryAfter)
+		}
+		http.Error(w, fault.Body, fault.Status)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.URL.Path == "/config" && r.Method == "GET" {
+		s.serveConfig(w)
+	} else if r.URL.Path == "/login_" && r.Method == "POST" {
+		s.serveLogin(w, body)
+	} else if r.URL.Path == "/user/register" && r.Method == "POST" {
+		s.serveRegister(w, body)
+	} else if m := keyPathRegexp.FindStringSubmatch(r.URL.Path); m != nil && r.Method == "POST" {
+		s.serveGenerateApiKey(w, r, m[1])
+	} else if m := pinePathRegexp.FindStringSubmatch(r.URL.Path); m != nil {
+		s.servePine(w, r, m[1], m[2], body)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+// Returns the fault to apply to the request, if any, using it up.
+func (s *Server) matchFault(r *http.Request) *Fault {
+	for i, f := range s.faults {
+		if (f.Method == "" || f.Method == r.Method) && strings.HasPrefix(r.URL.Path, f.Path) {
+			if f.Count > 0 {
+				f.Count--
+				if f.Count == 0 {
+					s.faults = append(s.faults[:i], s.faults[i+1:]...)
+				}
+			}
+			return f
+		}
+	}
+
+	return nil
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) serveConfig(w http.ResponseWriter) {
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"mixpanelToken": MixpanelToken,
+		"pubnub": map[string]string{
+			"publish_key":   PubnubPublishKey,
+			"subscribe_key": PubnubSubscribeKey,
+		},
+	})
+}
+
+func (s *Server) serveLogin(w http.ResponseWriter, body []byte) {
+	var creds struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.Unmarshal(body, &creds); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+	} else if u, ok := s.users[creds.Username]; !ok || u.password != creds.Password {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	} else {
+		w.Write([]byte(s.newToken(u)))
+	}
+}
+
+func (s *Server) serveRegister(w http.ResponseWriter, body []byte) {
+	var creds struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	if err := json.Unmarshal(body, &creds); err != nil || creds.Email == "" || creds.Password == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+	} else if _, ok := s.users[creds.Email]; ok {
+		http.Error(w, "This email is already taken", http.StatusConflict)
+	} else {
+		w.Write([]byte(s.newToken(s.addUser(creds.Email, creds.Password))))
+	}
+}
+
+func (s *Server) serveGenerateApiKey(w http.ResponseWriter, r *http.Request, appId string) {
+	id, _ := strconv.ParseInt(appId, 10, 64)
+
+	if u := s.tokenUser(r); u == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	} else if app, ok := s.apps[id]; !ok || app["user"] != u.id {
+		http.NotFound(w, r)
+	} else {
+		// The API returns the key as a bare JSON string.
+		key, _ := json.Marshal(s.newApiKey(id))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(key)
+	}
+}
+
+// Returns the user the request's bearer token authenticates, if any.
+func (s *Server) tokenUser(r *http.Request) *user {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil
+	}
+
+	return s.tokens[strings.TrimPrefix(auth, "Bearer ")]
+}
+
+// Returns whether the request may see or modify obj. Users may access their
+// own objects, API keys the devices of their application.
+func (s *Server) canAccess(r *http.Request, resource string, obj map[string]interface{}) bool {
+	if u := s.tokenUser(r); u != nil {
+		return obj["user"] == u.id
+	} else if appId, ok := s.apiKeys[r.URL.Query().Get("apikey")]; ok {
+		return resource == "device" && obj["application"] == appId
+	}
+
+	return false
+}
+
+func (s *Server) authenticated(r *http.Request) bool {
+	_, ok := s.apiKeys[r.URL.Query().Get("apikey")]
+	return ok || s.tokenUser(r) != nil
+}
+
+func (s *Server) servePine(w http.ResponseWriter, r *http.Request, resource, id string, body []byte) {
+	if !s.authenticated(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	objs := s.apps
+	if resource == "device" {
+		objs = s.devices
+	}
+
+	if r.Method == "GET" && id == "" {
+		s.pineList(w, r, resource, objs)
+	} else if r.Method == "POST" && id == "" {
+		s.pineCreate(w, r, resource, body)
+	} else if r.Method == "PATCH" && id != "" {
+		n, _ := strconv.ParseInt(id, 10, 64)
+		s.pinePatch(w, r, resource, objs[n], body)
+	} else {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) pineList(w http.ResponseWriter, r *http.Request, resource string,
+	objs map[int64]map[string]interface{}) {
+	match := func(map[string]interface{}) bool { return true }
+	if filter := r.URL.Query().Get("$filter"); filter != "" {
+		m := filterRegexp.FindStringSubmatch(filter)
+		if m == nil {
+			http.Error(w, "Unsupported filter", http.StatusBadRequest)
+			return
+		}
+		field, value := m[1], strings.Replace(m[2], "''", "'", -1)
+		if m[3] != "" {
+			value = m[3]
+		}
+		match = func(obj map[string]interface{}) bool {
+			return fmt.Sprint(obj[field]) == value
+		}
+	}
+
+	ret := make([]map[string]interface{}, 0)
+	for i := int64(1); i < s.nextId; i++ {
+		if obj, ok := objs[i]; ok && match(obj) && s.canAccess(r, resource, obj) {
+			ret = append(ret, s.render(resource, obj))
+		}
+	}
+
+	writeJson(w, http.StatusOK, map[string]interface{}{"d": ret})
+}
+
+func (s *Server) pineCreate(w http.ResponseWriter, r *http.Request, resource string, body []byte) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if resource == "application" {
+		if u := s.tokenUser(r); u == nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		} else {
+			name, _ := fields["app_name"].(string)
+			deviceType, _ := fields["device_type"].(string)
+			id := s.addApplication(u.id, name, deviceType)
+			writeJson(w, http.StatusCreated, s.render(resource, s.apps[id]))
+		}
+		return
+	}
+
+	uuid, _ := fields["uuid"].(string)
+	appId, appOk := toId(fields["application"])
+	userId, userOk := toId(fields["user"])
+	if uuid == "" || !appOk || !userOk {
+		http.Error(w, "Invalid device", http.StatusBadRequest)
+		return
+	}
+	for _, device := range s.devices {
+		if device["uuid"] == uuid {
+			http.Error(w, `"uuid" must be unique.`, http.StatusConflict)
+			return
+		}
+	}
+
+	if app, ok := s.apps[appId]; !ok || app["user"] != userId || !s.canAccess(r, "device",
+		map[string]interface{}{"application": appId, "user": userId}) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	delete(fields, "id")
+	id := s.addDevice(userId, appId, fields)
+	writeJson(w, http.StatusCreated, s.render(resource, s.devices[id]))
+}
+
+func (s *Server) pinePatch(w http.ResponseWriter, r *http.Request, resource string,
+	obj map[string]interface{}, body []byte) {
+	var fields map[string]interface{}
+	if obj == nil || !s.canAccess(r, resource, obj) {
+		http.NotFound(w, r)
+	} else if err := json.Unmarshal(body, &fields); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+	} else {
+		for key, value := range fields {
+			if key == "id" {
+				continue
+			} else if key == "application" || key == "user" {
+				if id, ok := toId(value); !ok {
+					http.Error(w, "Invalid "+key, http.StatusBadRequest)
+					return
+				} else if app, ok := s.apps[id]; key == "application" &&
+					(!ok || app["user"] != obj["user"]) {
+					http.Error(w, "Unauthorized", http.StatusUnauthorized)
+					return
+				} else {
+					value = id
+				}
+			}
+			obj[key] = value
+		}
+		w.Write([]byte("OK"))
+	}
+}
+
+// Parses an id sent as either a number or a string.
+func toId(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return int64(v), true
+	case string:
+		id, err := strconv.ParseInt(v, 10, 64)
+		return id, err == nil
+	}
+
+	return 0, false
+}
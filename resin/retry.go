@@ -0,0 +1,64 @@
+package resin
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// How requests to the API are retried on transient failures. Idempotent
+// requests are retried on network errors and 5xx responses, all requests on
+// 429 responses as these were not processed.
+type RetryPolicy struct {
+	// Including the first attempt, 1 disables retries.
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    30 * time.Second,
+}
+
+// Returns the delay before the specified retry (starting at 1), with full
+// jitter so clients don't retry in lockstep. A Retry-After header from the
+// last response takes precedence.
+func (p RetryPolicy) delay(retry int, header http.Header) time.Duration {
+	if after, ok := parseRetryAfter(header); ok {
+		if after > p.MaxDelay {
+			return p.MaxDelay
+		}
+		return after
+	}
+
+	max := p.BaseDelay << uint(retry-1)
+	if max <= 0 || max > p.MaxDelay {
+		max = p.MaxDelay
+	}
+	if max <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+func parseRetryAfter(header http.Header) (time.Duration, bool) {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+
+	if secs, err := strconv.Atoi(value); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	} else if at, err := http.ParseTime(value); err == nil {
+		if d := time.Until(at); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+
+	return 0, false
+}
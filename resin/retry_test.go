@@ -0,0 +1,88 @@
+package resin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var fastRetry = RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+
+// Returns a client for a server responding with each of statuses in turn,
+// then 200, along with a pointer to the number of requests made.
+func newFlakyClient(statuses ...int) (*Client, *int, func()) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests <= len(statuses) {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(statuses[requests-1])
+			return
+		}
+		w.Write([]byte(`{"mixpanelToken": "abc"}`))
+	}))
+
+	client := NewClient(server.URL)
+	client.Retry = fastRetry
+	return client, &requests, server.Close
+}
+
+func TestRetryIdempotent(t *testing.T) {
+	client, requests, cleanup := newFlakyClient(503, 502)
+	defer cleanup()
+
+	if _, err := client.GetConfig(context.Background()); err != nil {
+		t.Errorf("Expected success after retries: %s", err)
+	} else if *requests != 3 {
+		t.Errorf("Expected 3 requests, got %d", *requests)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	client, requests, cleanup := newFlakyClient(503, 503, 503, 503)
+	defer cleanup()
+
+	if _, err := client.GetConfig(context.Background()); !errors.Is(err, ErrTransient) {
+		t.Errorf("Expected transient error, got %v", err)
+	} else if *requests != fastRetry.MaxAttempts {
+		t.Errorf("Expected %d requests, got %d", fastRetry.MaxAttempts, *requests)
+	}
+}
+
+func TestNoRetryNonIdempotent(t *testing.T) {
+	client, requests, cleanup := newFlakyClient(500)
+	defer cleanup()
+
+	if _, err := client.WithToken("token").GetApiKey(context.Background(), "123"); !errors.Is(err, ErrTransient) {
+		t.Errorf("Expected transient error, got %v", err)
+	} else if *requests != 1 {
+		t.Errorf("Non-idempotent request retried, %d requests", *requests)
+	}
+
+	// Rate limited requests weren't processed so are safe to retry.
+	client, requests, cleanup = newFlakyClient(429)
+	defer cleanup()
+
+	if _, err := client.WithToken("token").GetApiKey(context.Background(), "123"); err != nil {
+		t.Errorf("Expected success after 429: %s", err)
+	} else if *requests != 2 {
+		t.Errorf("Expected 2 requests, got %d", *requests)
+	}
+}
+
+func TestClassifiedErrors(t *testing.T) {
+	for status, kind := range map[int]error{
+		401: ErrUnauthorized,
+		404: ErrNotFound,
+		409: ErrConflict,
+	} {
+		client, _, cleanup := newFlakyClient(status)
+		if _, err := client.GetConfig(context.Background()); !errors.Is(err, kind) {
+			t.Errorf("%d: expected %s, got %v", status, kind, err)
+		}
+		cleanup()
+	}
+}